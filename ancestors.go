@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// ancestorRestore is the restore of a trashed ancestor folder, shared by
+// all the files below it.
+type ancestorRestore struct {
+	// closed once err is set
+	done chan struct{}
+	err  error
+	// the ancestor this restore is waiting for, if any, guarded by
+	// ancestorsMutex
+	waitingOn string
+}
+
+// restoreAncestors restores the trashed folders above f, from the top
+// down, so that f is restored into a visible folder. chain are the folders
+// below f that led to it.
+func (r *restorer) restoreAncestors(f *drive.File, chain []string) error {
+	for _, parent := range f.Parents {
+		if err := r.restoreAncestor(parent.Id, append(chain, f.Id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreAncestor restores folderID and its ancestors if they're trashed,
+// once per run. The last of chain is the one asking for it.
+func (r *restorer) restoreAncestor(folderID string, chain []string) error {
+	if len(chain) >= maxParentsDepth {
+		return fmt.Errorf("more than %d folders above, giving up at folder %v", maxParentsDepth, folderID)
+	}
+	waiter := chain[len(chain)-1]
+	r.ancestorsMutex.Lock()
+	// with a loop in the parents, the restores along it would wait for
+	// each other forever, whichever goroutines they're in
+	for id := folderID; id != ""; {
+		if id == waiter {
+			r.ancestorsMutex.Unlock()
+			return fmt.Errorf("folder %v is its own ancestor", folderID)
+		}
+		a := r.ancestors[id]
+		if a == nil {
+			break
+		}
+		id = a.waitingOn
+	}
+	a, ok := r.ancestors[folderID]
+	if !ok {
+		a = &ancestorRestore{done: make(chan struct{})}
+		r.ancestors[folderID] = a
+	}
+	w := r.ancestors[waiter]
+	if w != nil {
+		w.waitingOn = folderID
+	}
+	r.ancestorsMutex.Unlock()
+
+	if ok {
+		<-a.done
+	} else {
+		a.err = r.untrashAncestor(folderID, chain)
+		close(a.done)
+	}
+	if w != nil {
+		r.ancestorsMutex.Lock()
+		w.waitingOn = ""
+		r.ancestorsMutex.Unlock()
+	}
+	return a.err
+}
+
+func (r *restorer) untrashAncestor(folderID string, chain []string) error {
+	r.trashedFoldersMutex.Lock()
+	trashed, ok := r.trashedFolders[folderID]
+	r.trashedFoldersMutex.Unlock()
+	if ok && !trashed {
+		return nil
+	}
+	var folder *drive.File
+	err := p.Call(func() (bool, error) {
+		if !spendCall() {
+			return false, errBudgetExhausted
+		}
+		defer apiCalls.time("get")()
+		var err error
+		folder, err = r.srv.Files.Get(folderID).SupportsAllDrives(true).Fields("id, title, explicitlyTrashed, labels(trashed), parents(id)").Context(r.ctx).Do()
+		return shouldRetry(err)
+	})
+	if err != nil {
+		return err
+	}
+	if !isTrashed(folder) {
+		r.rememberTrashed(folderID, false)
+		return nil
+	}
+	if err := r.restoreAncestors(folder, chain); err != nil {
+		return err
+	}
+	// a folder that's only trashed with its ancestor is back by now
+	if !folder.ExplicitlyTrashed {
+		r.rememberTrashed(folderID, false)
+		return nil
+	}
+	if dryRun {
+		log.Printf("Would restore parent folder %v %v", folder.Id, folder.Title)
+		atomic.AddUint64(&r.countParentsRestored, 1)
+		r.rememberTrashed(folderID, false)
+		return nil
+	}
+	err = p.Call(func() (bool, error) {
+		if !spendCall() {
+			return false, errBudgetExhausted
+		}
+		defer apiCalls.time("untrash")()
+		_, err := r.srv.Files.Untrash(folderID).SupportsAllDrives(true).Fields("id").Context(r.ctx).Do()
+		return shouldRetry(err)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Restored parent folder %v %v", folder.Id, folder.Title)
+	events.record("restored_parent", folder, "", nil)
+	atomic.AddUint64(&r.countParentsRestored, 1)
+	r.rememberTrashed(folderID, false)
+	return nil
+}
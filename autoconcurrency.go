@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// how often -concurrency-auto adjusts the number of restore workers
+const autoConcurrencyEvery = 10 * time.Second
+
+// rateLimited counts the rate limit errors seen by shouldRetry.
+var rateLimited uint64
+
+func countRateLimited() {
+	atomic.AddUint64(&rateLimited, 1)
+}
+
+// workerLimit is how many of the restore workers may run restores at
+// once, which -concurrency-auto moves between 1 and -workers, and
+// -ramp-duration raises from 1 to -workers.
+type workerLimit struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	n    int
+}
+
+// activeWorkers is nil unless -concurrency-auto or -ramp-duration is
+// given.
+var activeWorkers *workerLimit
+
+func newWorkerLimit(n int) *workerLimit {
+	l := &workerLimit{n: n}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// wait blocks worker i while it's above the limit, it's a no-op on a nil
+// workerLimit.
+func (l *workerLimit) wait(i int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	for i >= l.n {
+		l.cond.Wait()
+	}
+	l.mu.Unlock()
+}
+
+func (l *workerLimit) set(n int) {
+	l.mu.Lock()
+	l.n = n
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+// adjustConcurrency starts with a single restore worker and adds one at a
+// time while there's no rate limiting, up to max, and halves them when
+// there is, until ctx is done.
+func adjustConcurrency(ctx context.Context, l *workerLimit, max int) {
+	ticker := time.NewTicker(autoConcurrencyEvery)
+	defer ticker.Stop()
+	n := l.n
+	last := atomic.LoadUint64(&rateLimited)
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		current := atomic.LoadUint64(&rateLimited)
+		hits := current - last
+		last = current
+		switch {
+		case hits > 0 && n > 1:
+			n /= 2
+			logWarning("Rate limited %d times, down to %d restore workers", hits, n)
+		case hits == 0 && n < max:
+			n++
+			log.Printf("No rate limiting, up to %d restore workers", n)
+		default:
+			continue
+		}
+		l.set(n)
+	}
+}
+
+// rampConcurrency goes from a single restore worker up to max evenly over
+// d, for -ramp-duration, unless ctx is done first.
+func rampConcurrency(ctx context.Context, l *workerLimit, max int, d time.Duration) {
+	start := time.Now()
+	for n := 2; n <= max; n++ {
+		at := start.Add(d * time.Duration(n-1) / time.Duration(max-1))
+		select {
+		case <-time.After(time.Until(at)):
+		case <-ctx.Done():
+			return
+		}
+		l.set(n)
+	}
+	log.Printf("Ramped up to %d restore workers", max)
+}
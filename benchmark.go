@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"golang.org/x/net/context"
+)
+
+// listBenchmark walks folders the way a restore does, only counting what
+// it lists.
+type listBenchmark struct {
+	items   uint64
+	folders uint64
+
+	ctx   context.Context
+	srv   *drive.Service
+	wg    sync.WaitGroup
+	slots chan struct{}
+
+	seen      map[string]bool
+	seenMutex sync.Mutex
+
+	errors uint64
+}
+
+// benchmarkList lists the folders and everything below them with
+// concurrency listings at a time, and logs how fast that went.
+func benchmarkList(ctx context.Context, srv *drive.Service, folders []*drive.File, concurrency int) {
+	b := &listBenchmark{ctx: ctx, srv: srv, slots: make(chan struct{}, concurrency), seen: map[string]bool{}}
+	if len(folders) == 0 {
+		// the top folder of a shared drive has the ID of the drive
+		top := driveID
+		if top == "" {
+			top = "root"
+		}
+		folders = []*drive.File{{Id: top}}
+	}
+	callsBefore := apiCalls.snapshot()["list"].Calls
+	start := time.Now()
+	for _, folder := range folders {
+		b.walk(folder.Id)
+	}
+	b.wg.Wait()
+	elapsed := time.Since(start)
+	calls := apiCalls.snapshot()["list"].Calls - callsBefore
+	seconds := elapsed.Seconds()
+	log.Printf("Listed %d items in %d folders with %d calls in %v, with %d listings at a time", b.items, b.folders, calls, elapsed.Round(time.Millisecond), concurrency)
+	log.Printf("That is %.1f items/s and %.1f calls/s", float64(b.items)/seconds, float64(calls)/seconds)
+	if b.errors > 0 {
+		logError("Unable to list %d folders, the numbers above are missing them", b.errors)
+	}
+}
+
+// walk lists a folder in the background, and the folders in it.
+func (b *listBenchmark) walk(folderID string) {
+	b.seenMutex.Lock()
+	seen := b.seen[folderID]
+	b.seen[folderID] = true
+	b.seenMutex.Unlock()
+	if seen {
+		return
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		b.slots <- struct{}{}
+		var subfolders []string
+	queries:
+		for _, q := range folderQueries() {
+			var pageToken string
+			for {
+				files, next, err := getFolderPage(b.ctx, b.srv, folderID, q, pageToken)
+				if err != nil {
+					logError("Unable to list folder %q: %v", folderID, err)
+					atomic.AddUint64(&b.errors, 1)
+					break queries
+				}
+				atomic.AddUint64(&b.items, uint64(len(files)))
+				for _, f := range files {
+					if f.MimeType == "application/vnd.google-apps.folder" {
+						subfolders = append(subfolders, f.Id)
+					}
+				}
+				pageToken = next
+				if pageToken == "" {
+					break
+				}
+			}
+		}
+		atomic.AddUint64(&b.folders, 1)
+		// give the slot up before queueing the subfolders, which wait for one
+		<-b.slots
+		for _, id := range subfolders {
+			b.walk(id)
+		}
+	}()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// checkpoint is the state of a run that's saved to resume it later.
+type checkpoint struct {
+	// the folders listed in full along with all the folders below them,
+	// and their restores done. Folders only partly listed aren't in it,
+	// the resumed run lists them again.
+	Finished []string `json:"finished"`
+}
+
+// snapshotFinished returns the finished folders, holding the lock only for
+// as long as it takes to copy them.
+func (r *restorer) snapshotFinished() []string {
+	r.seenMutex.Lock()
+	finished := make([]string, 0, len(r.finished))
+	for id := range r.finished {
+		finished = append(finished, id)
+	}
+	r.seenMutex.Unlock()
+	sort.Strings(finished)
+	return finished
+}
+
+// loadFinished adds the finished folders of an earlier run, so that
+// they're not processed again, and carried over to the next checkpoint.
+func (r *restorer) loadFinished(finished []string) {
+	r.seenMutex.Lock()
+	defer r.seenMutex.Unlock()
+	for _, id := range finished {
+		r.finished[id] = true
+		r.seen[id]++
+	}
+}
+
+// finishHeld finishes the folders that waited for their held restores,
+// once restoreInOrder ran them all.
+func (r *restorer) finishHeld() {
+	r.seenMutex.Lock()
+	defer r.seenMutex.Unlock()
+	for _, id := range r.finishedHeld {
+		r.finished[id] = true
+	}
+	r.finishedHeld = nil
+}
+
+// writeCheckpoint saves the state of the run to path. It's written to a
+// temporary file first, so that a crash never leaves half a checkpoint.
+func (r *restorer) writeCheckpoint(path string) error {
+	b, err := json.Marshal(checkpoint{Finished: r.snapshotFinished()})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readCheckpoint loads the state saved by writeCheckpoint at path,
+// returning how many folders it skips.
+func (r *restorer) readCheckpoint(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var c checkpoint
+	if err := json.Unmarshal(b, &c); err != nil {
+		return 0, err
+	}
+	r.loadFinished(c.Finished)
+	return len(c.Finished), nil
+}
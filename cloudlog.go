@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/logging"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	cloudClient *logging.Client
+	// cloudOut is where the log went before -cloud-logging
+	cloudOut io.Writer
+	// cloudLogger is nil unless -cloud-logging is given.
+	cloudLogger *logging.Logger
+)
+
+// cloudWriter sends the lines of the standard logger to Cloud Logging, as
+// info. The other severities go through logAt.
+type cloudWriter struct{}
+
+func (cloudWriter) Write(b []byte) (int, error) {
+	cloudLogger.Log(logging.Entry{
+		Severity: logging.Info,
+		Payload:  strings.TrimSuffix(string(b), "\n"),
+	})
+	return len(b), nil
+}
+
+// logError and logWarning are log.Printf for errors and warnings, which
+// Cloud Logging gets with that severity rather than info.
+func logError(format string, v ...interface{}) {
+	logAt(logging.Error, fmt.Sprintf(format, v...))
+}
+
+func logWarning(format string, v ...interface{}) {
+	logAt(logging.Warning, fmt.Sprintf(format, v...))
+}
+
+// logCritical logs the error that ends the run.
+func logCritical(msg string) {
+	logAt(logging.Critical, msg)
+}
+
+// logAt logs msg like log.Print, with severity in Cloud Logging.
+func logAt(severity logging.Severity, msg string) {
+	if cloudLogger == nil {
+		log.Output(3, msg)
+		return
+	}
+	var b strings.Builder
+	log.New(&b, log.Prefix(), log.Flags()).Print(msg)
+	io.WriteString(cloudOut, b.String())
+	cloudLogger.Log(logging.Entry{Severity: severity, Payload: strings.TrimSuffix(b.String(), "\n")})
+}
+
+// openCloudLogging sends the log and the events to Cloud Logging in
+// project, authenticating with the application default credentials. The
+// log still goes where it went before too, since that's the only place a
+// fatal error ends up if the process exits before the entries are sent.
+func openCloudLogging(ctx context.Context, project string) error {
+	client, err := logging.NewClient(ctx, "projects/"+project)
+	if err != nil {
+		return err
+	}
+	client.OnError = func(err error) {
+		// the standard logger would send this to Cloud Logging again
+		os.Stderr.WriteString("Unable to write to Cloud Logging: " + err.Error() + "\n")
+	}
+	cloudClient = client
+	cloudLogger = client.Logger("drive-untrash")
+	cloudOut = log.Writer()
+	log.SetOutput(io.MultiWriter(cloudOut, cloudWriter{}))
+	return nil
+}
+
+// cloudRecord sends an event to Cloud Logging as a structured entry, it's
+// a no-op without -cloud-logging.
+func cloudRecord(e event) {
+	if cloudLogger == nil {
+		return
+	}
+	severity := logging.Info
+	if e.Error != "" {
+		severity = logging.Error
+	}
+	cloudLogger.Log(logging.Entry{Severity: severity, Payload: e, Labels: map[string]string{"run_id": e.RunID}})
+}
+
+// closeCloudLogging sends the buffered entries, it's a no-op without
+// -cloud-logging.
+func closeCloudLogging() {
+	if cloudClient == nil {
+		return
+	}
+	log.SetOutput(cloudOut)
+	if err := cloudClient.Close(); err != nil {
+		os.Stderr.WriteString("Unable to write to Cloud Logging: " + err.Error() + "\n")
+	}
+	cloudClient, cloudLogger = nil, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// how often the -control-file is read
+const controlCheckEvery = time.Second
+
+// The states of a run set through the -control-file.
+const (
+	controlRun int32 = iota
+	controlPause
+	controlStop
+)
+
+var controlState = controlRun
+
+// watchControlFile reads the file at path until ctx is done, pausing the
+// run while it says pause, resuming it on resume, and stopping it for good
+// on stop. A missing or empty file changes nothing.
+func watchControlFile(ctx context.Context, path string) {
+	ticker := time.NewTicker(controlCheckEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logError("Unable to read -control-file: %v", err)
+			}
+			continue
+		}
+		switch command := strings.ToLower(strings.TrimSpace(string(b))); command {
+		case "":
+		case "pause":
+			if atomic.CompareAndSwapInt32(&controlState, controlRun, controlPause) {
+				log.Printf("Pausing, the restores in flight finish but no new ones start until -control-file says resume")
+			}
+		case "resume":
+			if atomic.CompareAndSwapInt32(&controlState, controlPause, controlRun) {
+				log.Printf("Resuming")
+			}
+		case "stop":
+			if atomic.SwapInt32(&controlState, controlStop) != controlStop {
+				log.Printf("Stopping, waiting for the restores in flight to finish")
+				return
+			}
+		default:
+			logWarning("Unknown command %q in -control-file, expected pause, resume or stop", command)
+		}
+	}
+}
+
+// waitWhilePaused waits while the -control-file says pause, or until ctx
+// is done.
+func waitWhilePaused(ctx context.Context) {
+	for atomic.LoadInt32(&controlState) == controlPause {
+		select {
+		case <-time.After(controlCheckEvery):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// stopRequested reports whether the -control-file said stop, after which
+// no new work starts.
+func stopRequested() bool {
+	return atomic.LoadInt32(&controlState) == controlStop
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// driveURLPath matches the paths of Drive web URLs that have the ID in
+// them, like /file/d/<id>/view, /drive/u/0/folders/<id> or
+// /document/d/<id>/edit.
+var driveURLPath = regexp.MustCompile(`^(?:/drive(?:/u/\d+)?)?/(?:folders|(?:file|document|spreadsheets|presentation|forms|drawings)/d)/([\w-]+)(?:/|$)`)
+
+// parseID returns the file or folder ID in s, which can be the web URL of
+// the file or folder instead of its ID.
+func parseID(s string) (string, error) {
+	if !strings.HasPrefix(s, "https://") && !strings.HasPrefix(s, "http://") {
+		return s, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %q: %v", s, err)
+	}
+	if u.Host != "drive.google.com" && u.Host != "docs.google.com" {
+		return "", fmt.Errorf("%q is not a Google Drive URL", s)
+	}
+	if m := driveURLPath.FindStringSubmatch(u.Path); m != nil {
+		return m[1], nil
+	}
+	// like https://drive.google.com/open?id=<id>
+	if id := u.Query().Get("id"); id != "" {
+		return id, nil
+	}
+	return "", fmt.Errorf("unable to find a file or folder ID in URL %q", s)
+}
+
+// parseIDs applies parseID to all of ids.
+func parseIDs(ids []string) ([]string, error) {
+	parsed := make([]string, 0, len(ids))
+	for _, s := range ids {
+		id, err := parseID(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, id)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// folderName is where a folder seen in the walk is, to show paths.
+type folderName struct {
+	title  string
+	parent string
+}
+
+// rememberFolderName records the title and parent of a folder found
+// while walking, the first time it's found.
+func (r *restorer) rememberFolderName(id, title, parent string) {
+	r.folderNamesMutex.Lock()
+	if _, ok := r.folderNames[id]; !ok {
+		r.folderNames[id] = folderName{title: title, parent: parent}
+	}
+	r.folderNamesMutex.Unlock()
+}
+
+// folderPath returns the path of a folder from the titles of the folders
+// above it seen in the walk. Paths of folders found some other way start
+// with the ID of the topmost known folder.
+func (r *restorer) folderPath(id string) string {
+	titles, top := r.folderTitles(id)
+	if top == "" {
+		return "/" + strings.Join(titles, "/")
+	}
+	return top + ":/" + strings.Join(titles, "/")
+}
+
+// folderTitles returns the titles of the folders seen in the walk from
+// the topmost one down to id, and the ID of the folder above the topmost
+// one, empty if that's the root.
+func (r *restorer) folderTitles(id string) ([]string, string) {
+	r.folderNamesMutex.Lock()
+	defer r.folderNamesMutex.Unlock()
+	var titles []string
+	// the depth limit guards against loops in the parents
+	for depth := 0; ; depth++ {
+		if depth == maxParentsDepth {
+			logWarning("Folder %v has more than %d folders above it, not showing the rest of its path", id, maxParentsDepth)
+			break
+		}
+		if id == "" || id == "root" {
+			return titles, ""
+		}
+		name, ok := r.folderNames[id]
+		if !ok {
+			break
+		}
+		titles = append([]string{name.title}, titles...)
+		id = name.parent
+	}
+	return titles, id
+}
+
+// logGroups logs the files that would be restored by folder, sorted by
+// the folder path.
+func (r *restorer) logGroups() {
+	r.resultsMutex.Lock()
+	defer r.resultsMutex.Unlock()
+	type group struct {
+		id, path string
+		files    []*drive.File
+	}
+	groups := make([]group, 0, len(r.groups))
+	for id, files := range r.groups {
+		groups = append(groups, group{id: id, path: r.folderPath(id), files: files})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].path < groups[j].path
+	})
+	for _, g := range groups {
+		log.Printf("%s (%s): %d files would reappear", g.path, g.id, len(g.files))
+		sort.Slice(g.files, func(i, j int) bool {
+			return g.files[i].Title < g.files[j].Title
+		})
+		for _, f := range g.files {
+			line := fmt.Sprintf("  %s (%s)", f.Title, f.Id)
+			if f.MimeType == "application/vnd.google-apps.folder" {
+				line = fmt.Sprintf("  %s/ (%s)", f.Title, f.Id)
+			}
+			log.Print(line)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// quoteQuery quotes s as a string in a Drive query.
+func quoteQuery(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `'`, `\'`)
+	return "'" + s + "'"
+}
+
+// existingCopy returns a file outside the trash in one of the parents of f
+// with the same title as f, and with -skip-if-exists-md5 the same content,
+// or nil if there's none.
+func (r *restorer) existingCopy(f *drive.File) (*drive.File, error) {
+	for _, parent := range f.Parents {
+		q := fmt.Sprintf("%s in parents and title = %s and trashed = false", quoteQuery(parent.Id), quoteQuery(f.Title))
+		files, _, err := getPage(r.ctx, r.srv, q, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, existing := range files {
+			if existing.Id == f.Id {
+				continue
+			}
+			if skipIfExistsMd5 && existing.Md5Checksum != f.Md5Checksum {
+				continue
+			}
+			return existing, nil
+		}
+	}
+	return nil, nil
+}
+
+// isDuplicate reports whether f shouldn't be restored because a copy of it
+// already exists, counting it if so.
+func (r *restorer) isDuplicate(f *drive.File, folderID string) bool {
+	existing, err := r.existingCopy(f)
+	if err != nil {
+		logError("Unable to look for copies of %v %v in folder %v, restoring it anyway: %v", f.Id, f.Title, folderID, err)
+		return false
+	}
+	if existing == nil {
+		return false
+	}
+	if verbose {
+		log.Printf("Skipping %v %v in folder %v, %v with the same name already exists", f.Id, f.Title, folderID, existing.Id)
+	}
+	atomic.AddUint64(&r.countSkippedDuplicate, 1)
+	if finalVerifyMode {
+		r.report("left_alone", f, folderID, nil)
+	}
+	return true
+}
+
+// findNewest sets the most recently modified of each group of trashed
+// duplicates for -dedup-restore keep-newest, going through the trash
+// matching q before the run. Only the duplicates the run would restore
+// count, the ones skipped by the filters or outside the folders in roots,
+// if any, can't stand in for the others.
+func (r *restorer) findNewest(q string, roots []string) error {
+	groups := map[string][]*drive.File{}
+	err := walkQuery(r.ctx, r.srv, q, func(f *drive.File) {
+		if key := duplicateKey(f); key != "" {
+			groups[key] = append(groups[key], f)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	inRoots := map[string]bool{}
+	for _, id := range roots {
+		inRoots[id] = true
+	}
+	parents := map[string][]string{}
+	r.newest = make(map[string]string, len(groups))
+	for key, files := range groups {
+		var newest *drive.File
+		for _, f := range files {
+			if len(files) > 1 {
+				if reason, _ := r.skipReason(f); reason != "" {
+					continue
+				}
+				if len(roots) > 0 && !r.inFolders(f, inRoots, parents) {
+					continue
+				}
+			}
+			if newest == nil || modifiedAfter(f, newest) {
+				newest = f
+			}
+		}
+		if newest != nil {
+			r.newest[key] = newest.Id
+		}
+	}
+	return nil
+}
+
+// inFolders reports whether f is somewhere inside one of the folders in
+// roots, looking up the parents of its ancestors, which are cached in
+// parents. Ancestors that can't be looked up count as outside.
+func (r *restorer) inFolders(f *drive.File, roots map[string]bool, parents map[string][]string) bool {
+	var queue []string
+	for _, parent := range f.Parents {
+		queue = append(queue, parent.Id)
+	}
+	seen := map[string]bool{}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if roots[id] {
+			return true
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids, ok := parents[id]
+		if !ok {
+			var pf *drive.File
+			err := p.Call(func() (bool, error) {
+				if !spendCall() {
+					return false, errBudgetExhausted
+				}
+				defer apiCalls.time("get")()
+				var err error
+				pf, err = r.srv.Files.Get(id).SupportsAllDrives(true).Fields("parents(id)").Context(r.ctx).Do()
+				return shouldRetry(err)
+			})
+			if err != nil {
+				logError("Unable to get folder %v above %v %v, assuming it's outside the folders: %s%s", id, f.Id, f.Title, err, requestInfo(err))
+			} else {
+				for _, parent := range pf.Parents {
+					ids = append(ids, parent.Id)
+				}
+			}
+			parents[id] = ids
+		}
+		queue = append(queue, ids...)
+	}
+	return false
+}
+
+// modifiedAfter reports whether a was modified after b.
+func modifiedAfter(a, b *drive.File) bool {
+	ta, erra := time.Parse(time.RFC3339, a.ModifiedDate)
+	tb, errb := time.Parse(time.RFC3339, b.ModifiedDate)
+	if erra != nil || errb != nil {
+		return erra == nil
+	}
+	return ta.After(tb)
+}
+
+// hasNewerDuplicate reports whether -dedup-restore keep-newest restores a
+// newer trashed duplicate of f instead.
+func (r *restorer) hasNewerDuplicate(f *drive.File) bool {
+	if r.newest == nil {
+		return false
+	}
+	id, ok := r.newest[duplicateKey(f)]
+	return ok && id != f.Id
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// event is a single restore outcome written by -jsonl.
+type event struct {
+	Time     time.Time `json:"time"`
+	RunID    string    `json:"run_id"`
+	Event    string    `json:"event"`
+	ID       string    `json:"id"`
+	Title    string    `json:"title"`
+	MimeType string    `json:"mime_type"`
+	Folder   string    `json:"folder"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// eventFields are the JSON names of the fields of an event, in order.
+var eventFields = []string{"time", "run_id", "event", "id", "title", "mime_type", "folder", "error"}
+
+// reportFields are the fields written with -report-fields, nil for all of
+// them.
+var reportFields map[string]bool
+
+// parseReportFields returns the set of event fields in a comma-separated
+// list like "id,title".
+func parseReportFields(list string) (map[string]bool, error) {
+	fields := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, field := range eventFields {
+			known = known || field == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown field %q, expected some of %s", name, strings.Join(eventFields, ","))
+		}
+		fields[name] = true
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields given")
+	}
+	return fields, nil
+}
+
+// only returns e as a JSON object with just the given fields.
+func (e event) only(fields map[string]bool) (json.RawMessage, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, name := range eventFields {
+		value, ok := all[name]
+		if !ok || !fields[name] {
+			continue
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%q:%s", name, value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// eventLog writes events as JSON lines from a background goroutine,
+// flushing them in batches so that the output can be followed live
+// without holding all of it in memory.
+type eventLog struct {
+	c    chan event
+	done chan struct{}
+}
+
+// events is nil unless -jsonl is given.
+var events *eventLog
+
+// openEventLog opens the -jsonl output, "-" meaning stdout. The events are
+// flushed every batchSize events and at least every flushInterval.
+func openEventLog(path string, batchSize int, flushInterval time.Duration) (*eventLog, error) {
+	var w io.WriteCloser = os.Stdout
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	l := &eventLog{c: make(chan event, batchSize), done: make(chan struct{})}
+	go l.write(w, batchSize, flushInterval)
+	return l, nil
+}
+
+func (l *eventLog) write(w io.WriteCloser, batchSize int, flushInterval time.Duration) {
+	defer close(l.done)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	pending := 0
+	flush := func() {
+		if err := bw.Flush(); err != nil {
+			logError("Unable to write events: %v", err)
+		}
+		pending = 0
+	}
+	for {
+		select {
+		case e, ok := <-l.c:
+			if !ok {
+				flush()
+				if w != os.Stdout {
+					w.Close()
+				}
+				return
+			}
+			var out interface{} = e
+			if reportFields != nil {
+				var err error
+				out, err = e.only(reportFields)
+				if err != nil {
+					logError("Unable to write event: %v", err)
+					continue
+				}
+			}
+			if err := enc.Encode(out); err != nil {
+				logError("Unable to write event: %v", err)
+			}
+			pending++
+			if pending >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			if pending > 0 {
+				flush()
+			}
+		}
+	}
+}
+
+// record writes an event about f, and sends it to Cloud Logging with
+// -cloud-logging. It's a no-op on a nil eventLog otherwise.
+func (l *eventLog) record(kind string, f *drive.File, folderID string, err error) {
+	if l == nil && cloudLogger == nil {
+		return
+	}
+	e := event{
+		Time:     time.Now().UTC(),
+		RunID:    runID,
+		Event:    kind,
+		ID:       f.Id,
+		Title:    f.Title,
+		MimeType: f.MimeType,
+		Folder:   folderID,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	cloudRecord(e)
+	if l != nil {
+		l.c <- e
+	}
+}
+
+// close writes out the pending events, it's a no-op on a nil eventLog.
+func (l *eventLog) close() {
+	if l == nil {
+		return
+	}
+	close(l.c)
+	<-l.done
+}
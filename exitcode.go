@@ -0,0 +1,39 @@
+package main
+
+import "errors"
+
+// The exit codes of a run, for scripts to tell the outcomes apart.
+const (
+	exitOK = 0
+	// the run couldn't start or stopped on an error, like a bad flag
+	exitError = 1
+	// some files weren't restored, or some folders weren't listed
+	exitPartial = 2
+	// the -max-api-calls budget or a Drive quota ran out
+	exitQuota = 3
+	// some folders took longer than -max-runtime-per-folder
+	exitTimedOut = 4
+	// the token is invalid or lacks the scope
+	exitAuth = 5
+	// a given folder doesn't exist or can't be accessed
+	exitNoAccess = 6
+)
+
+// codedError is an error that ends the run with a specific exit code.
+type codedError struct {
+	code int
+	err  error
+}
+
+func (e codedError) Error() string { return e.err.Error() }
+
+func (e codedError) Unwrap() error { return e.err }
+
+// exitCode returns the exit code for an error that ends the run.
+func exitCode(err error) int {
+	var ce codedError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	return exitError
+}
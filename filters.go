@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// validateFilters checks the filter flags against each other, so that a
+// typo fails the run before it starts rather than matching nothing.
+func validateFilters() error {
+	for _, pattern := range excludeMime {
+		parts := strings.Split(pattern, "/")
+		if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(pattern, " ,") {
+			return fmt.Errorf("-exclude-mime %q isn't a MIME type like image/png or a family like image/", pattern)
+		}
+	}
+	for ext := range includeExt {
+		if strings.ContainsAny(ext, "/ *") {
+			return fmt.Errorf("-ext %q isn't an extension like pdf", ext)
+		}
+		if excludeExt[ext] {
+			return fmt.Errorf("extension %q is in both -ext and -exclude-ext", ext)
+		}
+	}
+	for ext := range excludeExt {
+		if strings.ContainsAny(ext, "/ *") {
+			return fmt.Errorf("-exclude-ext %q isn't an extension like pdf", ext)
+		}
+	}
+	if !createdAfter.IsZero() && !createdBefore.IsZero() && !createdAfter.Before(createdBefore.Time) {
+		return fmt.Errorf("-created-after %v isn't before -created-before %v", createdAfter.String(), createdBefore.String())
+	}
+	if minTrashedAge < 0 {
+		return fmt.Errorf("-trashed-before-age %v is negative", minTrashedAge)
+	}
+	if folderCutoff.After(time.Now()) {
+		return fmt.Errorf("-folder-modified-after %v is in the future, no folder would be looked into", folderCutoff.String())
+	}
+	if trashedBy != "" && !strings.Contains(trashedBy, "@") {
+		return fmt.Errorf("-trashed-by %q isn't an email address", trashedBy)
+	}
+	return nil
+}
+
+// describeFilters returns what the filters restore, in words.
+func describeFilters() string {
+	var filters []string
+	if len(excludeMime) > 0 {
+		filters = append(filters, "not of type "+strings.Join(excludeMime, " or "))
+	}
+	if len(includeExt) > 0 {
+		filters = append(filters, "with extension "+strings.Join(sortedKeys(includeExt), " or "))
+	}
+	if len(excludeExt) > 0 {
+		filters = append(filters, "without extension "+strings.Join(sortedKeys(excludeExt), " or "))
+	}
+	if minTrashedAge > 0 {
+		filters = append(filters, fmt.Sprintf("trashed more than %v ago", minTrashedAge))
+	}
+	if !createdAfter.IsZero() {
+		filters = append(filters, "created from "+createdAfter.String())
+	}
+	if !createdBefore.IsZero() {
+		filters = append(filters, "created before "+createdBefore.String())
+	}
+	if trashedBy != "" {
+		filters = append(filters, "trashed by "+trashedBy)
+	}
+	if wasInParent != "" {
+		filters = append(filters, "that were in folder "+wasInParent)
+	}
+	if !folderCutoff.IsZero() {
+		filters = append(filters, "in folders modified from "+folderCutoff.String())
+	}
+	if rootsOnly {
+		filters = append(filters, "not inside a trashed folder")
+	}
+	if skipOrphans {
+		filters = append(filters, "with a parent outside the trash")
+	}
+	if samplePercent < 100 {
+		filters = append(filters, fmt.Sprintf("in the %v%% sample", samplePercent))
+	}
+	if dedupRestore != "" {
+		filters = append(filters, "newest of their trashed duplicates")
+	}
+	if restoredIDsDir != "" {
+		filters = append(filters, "not restored by an earlier run")
+	}
+	if skipIfExists {
+		filters = append(filters, "without a copy already in their folder")
+	}
+	if len(filters) == 0 {
+		return "all the trashed files"
+	}
+	return "the trashed files " + strings.Join(filters, ", ")
+}
+
+// sortedKeys returns the keys of set in order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// finalVerify lists the whole trash once more after the run, and returns
+// the files still in it that should have been restored: the ones the run
+// tried to restore and didn't leave alone on purpose. The filters were
+// applied already when the run came across them, and files in the folders
+// it didn't walk aren't its business.
+func (r *restorer) finalVerify() ([]*drive.File, error) {
+	var left []*drive.File
+	err := walkTrash(r.ctx, r.srv, func(f *drive.File) {
+		r.resultsMutex.Lock()
+		intended := r.intended[f.Id]
+		r.resultsMutex.Unlock()
+		if intended {
+			left = append(left, f)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range left {
+		logError("Verification failed, %v %v is still in the trash", f.Id, f.Title)
+		events.record("still_trashed", f, "", nil)
+	}
+	log.Printf("Final verification found %d files still in the trash", len(left))
+	return left, nil
+}
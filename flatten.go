@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// flattenSeparator joins the folder titles of the original path of a file
+// and its own title into its name in the -flatten-to folder.
+const flattenSeparator = "__"
+
+// flattenedTitle returns the name of f in the -flatten-to folder, like
+// Projects__2023__report.xlsx for report.xlsx in folder 2023 of Projects.
+func (r *restorer) flattenedTitle(f *drive.File, folderID string) string {
+	titles, _ := r.folderTitles(folderID)
+	return strings.Join(append(titles, f.Title), flattenSeparator)
+}
+
+// moveToFlattened moves a restored file into the -flatten-to folder,
+// renamed after its original path. Like moveToRecovery, files whose folder
+// is trashed are left alone, they come back with it.
+func (r *restorer) moveToFlattened(f *drive.File, folderID string) {
+	r.trashedFoldersMutex.Lock()
+	parentTrashed := r.trashedFolders[folderID]
+	r.trashedFoldersMutex.Unlock()
+	if parentTrashed {
+		return
+	}
+	var parents []string
+	for _, parent := range f.Parents {
+		parents = append(parents, parent.Id)
+	}
+	title := r.flattenedTitle(f, folderID)
+	err := p.Call(func() (bool, error) {
+		if !spendCall() {
+			return false, errBudgetExhausted
+		}
+		defer apiCalls.time("move")()
+		call := r.srv.Files.Patch(f.Id, &drive.File{Title: title}).SupportsAllDrives(true).AddParents(flattenTo).Fields("id")
+		if len(parents) > 0 {
+			call.RemoveParents(strings.Join(parents, ","))
+		}
+		_, err := call.Context(r.ctx).Do()
+		return shouldRetry(err)
+	})
+	if err != nil {
+		logError("Unable to move restored %v %v into the -flatten-to folder: %s%s", f.Id, f.Title, err, requestInfo(err))
+		return
+	}
+	if verbose {
+		log.Printf("Moved %v %v from folder %v into the -flatten-to folder as %v", f.Id, f.Title, folderID, title)
+	}
+}
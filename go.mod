@@ -3,9 +3,15 @@ module github.com/hmage/drive-untrash
 go 1.15
 
 require (
+	cloud.google.com/go/logging v1.1.0
 	github.com/rclone/rclone v1.53.3
-	golang.org/x/net v0.0.0-20200813134508-3edf25e44fcc
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	golang.org/x/net v0.0.0-20200822124328-c89045814202
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	golang.org/x/sys v0.0.0-20220622161953-175b2fd9d664 // indirect
 	google.golang.org/api v0.30.0
+	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 )
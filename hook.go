@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"golang.org/x/net/context"
+)
+
+// hookPool runs the -after-restore-hook commands on goroutines of its own,
+// so that slow commands don't hold up the restore workers. The commands
+// wait for a free goroutine in a queue.
+type hookPool struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []hookJob
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+type hookJob struct {
+	ctx      context.Context
+	f        *drive.File
+	folderID string
+}
+
+// hooks is nil without -after-restore-hook.
+var hooks *hookPool
+
+// startHooks starts n goroutines running the queued hooks.
+func startHooks(n int) *hookPool {
+	h := &hookPool{}
+	h.cond = sync.NewCond(&h.mu)
+	for i := 0; i < n; i++ {
+		h.wg.Add(1)
+		go h.run()
+	}
+	return h
+}
+
+// queue queues the hook of a restored file, without waiting for it.
+func (h *hookPool) queue(ctx context.Context, f *drive.File, folderID string) {
+	h.mu.Lock()
+	h.pending = append(h.pending, hookJob{ctx: ctx, f: f, folderID: folderID})
+	h.mu.Unlock()
+	h.cond.Signal()
+}
+
+func (h *hookPool) run() {
+	defer h.wg.Done()
+	for {
+		h.mu.Lock()
+		for len(h.pending) == 0 && !h.closed {
+			h.cond.Wait()
+		}
+		if len(h.pending) == 0 {
+			h.mu.Unlock()
+			return
+		}
+		job := h.pending[0]
+		h.pending = h.pending[1:]
+		h.mu.Unlock()
+		runAfterRestoreHook(job.ctx, job.f, job.folderID)
+	}
+}
+
+// wait waits for the queued hooks to finish, no more can be queued then.
+// It's a no-op on a nil hookPool.
+func (h *hookPool) wait() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.closed = true
+	h.mu.Unlock()
+	h.cond.Broadcast()
+	h.wg.Wait()
+}
+
+// runAfterRestoreHook runs the -after-restore-hook command for a restored
+// file, with its ID and title as arguments and in the environment. The
+// restore stands whatever the command does, a failure is only logged.
+func runAfterRestoreHook(ctx context.Context, f *drive.File, folderID string) {
+	ctx, cancel := context.WithTimeout(ctx, afterRestoreHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, afterRestoreHook, f.Id, f.Title)
+	cmd.Env = append(os.Environ(),
+		"DRIVE_UNTRASH_FILE_ID="+f.Id,
+		"DRIVE_UNTRASH_FILE_TITLE="+f.Title,
+		"DRIVE_UNTRASH_FOLDER_ID="+folderID,
+		"DRIVE_UNTRASH_RUN_ID="+runID,
+	)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		logWarning("After-restore hook for %v %v didn't finish within %v", f.Id, f.Title, afterRestoreHookTimeout)
+	} else if err != nil {
+		logWarning("After-restore hook for %v %v failed: %v: %s", f.Id, f.Title, err, strings.TrimSpace(string(out)))
+	} else if verbose && len(out) > 0 {
+		log.Printf("After-restore hook for %v %v: %s", f.Id, f.Title, strings.TrimSpace(string(out)))
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+func TestHooksDontHoldUpRestores(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("no sleep command")
+	}
+	defer func(hook string, timeout time.Duration) {
+		afterRestoreHook, afterRestoreHookTimeout = hook, timeout
+	}(afterRestoreHook, afterRestoreHookTimeout)
+	// runs sleep 0.1 0.1
+	afterRestoreHook, afterRestoreHookTimeout = "sleep", time.Minute
+
+	h := startHooks(1)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		h.queue(context.Background(), &drive.File{Id: "0.1", Title: "0.1"}, "root")
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("queueing took %v, the restores waited for the hooks", d)
+	}
+	h.wait()
+	if d := time.Since(start); d < 600*time.Millisecond {
+		t.Errorf("the three hooks were done after %v, before they could have run", d)
+	}
+}
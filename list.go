@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"golang.org/x/net/context"
+)
+
+// purgeAge is how long Drive keeps files in the trash before deleting them
+// for good.
+const purgeAge = 30 * 24 * time.Hour
+
+// walkTrash calls fn for every explicitly trashed item, without restoring
+// anything.
+func walkTrash(ctx context.Context, srv *drive.Service, fn func(f *drive.File)) error {
+	return walkQuery(ctx, srv, "trashed = true", fn)
+}
+
+// walkQuery calls fn for every explicitly trashed item matching q.
+func walkQuery(ctx context.Context, srv *drive.Service, q string, fn func(f *drive.File)) error {
+	var pageToken string
+	for {
+		files, next, err := getPage(ctx, srv, q, pageToken)
+		if err != nil {
+			return fmt.Errorf("Failed to get file listing: %w", err)
+		}
+		for _, f := range files {
+			if f.ExplicitlyTrashed {
+				fn(f)
+			}
+		}
+		pageToken = next
+		if pageToken == "" {
+			return nil
+		}
+	}
+}
+
+// listExpiring writes the trashed items that have been in the trash for
+// longer than minAge as CSV to stdout, and to the -jsonl output if any.
+func listExpiring(ctx context.Context, srv *drive.Service, minAge time.Duration) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"id", "title", "mime_type", "trashed_date", "days_left"})
+	var count int
+	err := walkTrash(ctx, srv, func(f *drive.File) {
+		trashed, err := time.Parse(time.RFC3339, f.TrashedDate)
+		if err != nil {
+			logError("Unable to parse trashed time %q of %v %v: %v", f.TrashedDate, f.Id, f.Title, err)
+			return
+		}
+		age := time.Since(trashed)
+		if age < minAge {
+			return
+		}
+		count++
+		daysLeft := int((purgeAge - age).Hours() / 24)
+		w.Write([]string{f.Id, f.Title, f.MimeType, f.TrashedDate, fmt.Sprint(daysLeft)})
+		events.record("expiring", f, "", nil)
+	})
+	w.Flush()
+	if err != nil {
+		return err
+	}
+	if err := w.Error(); err != nil {
+		return err
+	}
+	log.Printf("Found %d trashed items older than %v", count, minAge)
+	return nil
+}
+
+// listOwners writes the number of trashed items per owner email to stdout,
+// most first.
+func listOwners(ctx context.Context, srv *drive.Service) error {
+	counts := map[string]int{}
+	var total int
+	err := walkTrash(ctx, srv, func(f *drive.File) {
+		total++
+		if len(f.Owners) == 0 {
+			counts["(unknown)"]++
+			return
+		}
+		for _, owner := range f.Owners {
+			counts[owner.EmailAddress]++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	owners := make([]string, 0, len(counts))
+	for owner := range counts {
+		owners = append(owners, owner)
+	}
+	sort.Slice(owners, func(i, j int) bool {
+		if counts[owners[i]] != counts[owners[j]] {
+			return counts[owners[i]] > counts[owners[j]]
+		}
+		return owners[i] < owners[j]
+	})
+	for _, owner := range owners {
+		fmt.Printf("%d\t%s\n", counts[owner], owner)
+	}
+	log.Printf("Found %d trashed items owned by %d owners", total, len(owners))
+	return nil
+}
+
+// duplicateKey returns what trashed duplicates of f have in common: the
+// content checksum, or the title and size for files without one, like
+// Google Docs. It's empty for folders, which aren't compared.
+func duplicateKey(f *drive.File) string {
+	if f.MimeType == "application/vnd.google-apps.folder" {
+		return ""
+	}
+	if f.Md5Checksum != "" {
+		return "md5:" + f.Md5Checksum
+	}
+	return fmt.Sprintf("title:%s/%d", f.Title, f.FileSize)
+}
+
+// listDuplicates writes the trashed files that have trashed duplicates as
+// CSV to stdout, the largest groups first.
+func listDuplicates(ctx context.Context, srv *drive.Service) error {
+	groups := map[string][]*drive.File{}
+	err := walkTrash(ctx, srv, func(f *drive.File) {
+		if key := duplicateKey(f); key != "" {
+			groups[key] = append(groups[key], f)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	var keys []string
+	var duplicates int
+	for key, files := range groups {
+		if len(files) > 1 {
+			keys = append(keys, key)
+			duplicates += len(files) - 1
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(groups[keys[i]]) != len(groups[keys[j]]) {
+			return len(groups[keys[i]]) > len(groups[keys[j]])
+		}
+		return keys[i] < keys[j]
+	})
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"group", "id", "title", "mime_type", "size", "modified_date"})
+	for _, key := range keys {
+		for _, f := range groups[key] {
+			w.Write([]string{key, f.Id, f.Title, f.MimeType, fmt.Sprint(f.FileSize), f.ModifiedDate})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	log.Printf("Found %d groups of trashed duplicates, %d files more than one of each", len(keys), duplicates)
+	return nil
+}
+
+// streamTrash writes every trashed item to stdout as a JSON line as soon
+// as it's listed, with the fields of a listing.
+func streamTrash(ctx context.Context, srv *drive.Service) error {
+	// unbuffered, each line is written as a whole
+	enc := json.NewEncoder(os.Stdout)
+	var count int
+	var encodeErr error
+	err := walkTrash(ctx, srv, func(f *drive.File) {
+		if encodeErr != nil {
+			return
+		}
+		count++
+		encodeErr = enc.Encode(f)
+	})
+	if err != nil {
+		return err
+	}
+	if encodeErr != nil {
+		return encodeErr
+	}
+	log.Printf("Streamed %d trashed items", count)
+	return nil
+}
@@ -1,17 +1,25 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"net/url"
 	"os"
-	"sync"
-	"sync/atomic"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	drive "google.golang.org/api/drive/v2"
 	"google.golang.org/api/googleapi"
@@ -21,149 +29,762 @@ import (
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 var (
-	p             *pacer.Pacer
-	verbose       bool
-	countRestored uint64
-	countFolders  uint64
-	wg            sync.WaitGroup
+	p       *retryPacer
+	verbose bool
+
+	logRequestIDs bool
+
+	// restoreQueue feeds the pool of restore workers
+	restoreQueue            chan func()
+	workers                 int
+	folderWorkersMax        int
+	excludeMime             stringsFlag
+	dumpFolderTree          bool
+	rootsOnly               bool
+	trashedFolderNoRecurse  bool
+	flat                    bool
+	bfs                     bool
+	verifyMetadata          bool
+	verifyRevisions         bool
+	recoveryFolder          bool
+	refetchPartial          bool
+	userAgent               string
+	metadataDumpPath        string
+	pauseOnQuota            bool
+	restoreParents          bool
+	skipIfExists            bool
+	skipIfExistsMd5         bool
+	milestone               uint64
+	readOnly                bool
+	foldersList             string
+	trashedCount            bool
+	sharedWithMe            bool
+	runID                   string
+	listWorkers             int
+	planOut                 string
+	planIn                  string
+	startJitter             time.Duration
+	refreshToken            string
+	followShortcuts         bool
+	createdAfter            timeFlag
+	createdBefore           timeFlag
+	dryRunByFolder          bool
+	includeExtList          string
+	excludeExtList          string
+	includeExt              map[string]bool
+	excludeExt              map[string]bool
+	cloudLoggingProject     string
+	finalVerifyMode         bool
+	maxParentsDepth         int
+	progressEvery           time.Duration
+	skipOrphans             bool
+	corpora                 string
+	driveID                 string
+	benchmarkListMode       bool
+	verifyChecksum          bool
+	onlyTrashedFolders      bool
+	memLimit                int
+	trashedBy               string
+	otelEndpoint            string
+	twoPhaseListing         bool
+	reportFieldList         string
+	restoredIDsDir          string
+	afterRestoreHook        string
+	afterRestoreHookTimeout time.Duration
+	afterRestoreHookJobs    int
+	restoreOrder            string
+	samplePercent           float64
+	tagRestored             bool
+	listDuplicatesMode      bool
+	dedupRestore            string
+	streamMode              bool
+	flattenTo               string
+	retries5xx              int
+	retriesRateLimit        int
+	retriesNetwork          int
+	controlFile             string
+	sharedDriveTrash        string
+	concurrencyAuto         bool
+	sheetOutput             string
+	sheetFiles              bool
+	rampDuration            time.Duration
+	sizeBudget              int64
+	sizeBudgetOrder         string
+	resumeFrom              string
+	rateLimitBackoffBase    time.Duration
+	serveToken              string
+	folderCutoff            timeFlag
+	jsonlPath               string
+	jsonlBatchSize          int
+	jsonlFlushEvery         time.Duration
+	folderTimeout           time.Duration
+	serveAddr               string
+	profile                 string
+	clientSecretPath        string
+	reconcileAttempts       int
+	logFile                 string
+	logMaxSize              int
+	logMaxBackups           int
+	simulateFailureRate     float64
+	wasInParent             string
+	listExpiringMode        bool
+	listOwnersMode          bool
+	expiringDays            int
+	minTrashedAge           time.Duration
+	largestFirst            int
+
+	dryRun       bool
+	dryRunSample int
 )
 
-func restoreTrashed(srv *drive.Service, folderID string, childs []*drive.File, recurse bool) {
-	// parent is only for logging purposes
-	if folderID == "" {
-		folderID = "root"
-	}
-	for _, child := range childs {
-		if child.ExplicitlyTrashed {
-			wg.Add(1)
-			go func(child *drive.File, folderID string) {
-				if verbose {
-					log.Printf("Restoring %v %v in folder %v", child.Id, child.Title, folderID)
-				}
-				err := p.Call(func() (bool, error) {
-					_, err := srv.Files.Untrash(child.Id).Do()
-					return shouldRetry(err)
-				})
-				if err != nil {
-					log.Printf("Failed to restore file %v %v in folder %v: %s", child.Id, child.Title, folderID, err)
-				} else {
-					if verbose {
-						log.Printf("Restored %v %v in folder %v", child.Id, child.Title, folderID)
-					}
-					atomic.AddUint64(&countRestored, 1)
-				}
-				wg.Done()
-			}(child, folderID)
+// failure classes, in the order they're reported in
+var failureClasses = []string{"rate-limited", "quota", "not-owner", "permission", "not-found", "server", "other"}
+
+// classifyError tells what kind of failure err is, to see at a glance
+// whether the failures are worth retrying.
+func classifyError(err error) string {
+	gerr, ok := googleError(err)
+	if !ok {
+		return "other"
+	}
+	if len(gerr.Errors) > 0 {
+		switch gerr.Errors[0].Reason {
+		case "rateLimitExceeded", "userRateLimitExceeded":
+			// only returned once the retries are exhausted
+			return "rate-limited"
+		case "quotaExceeded", "dailyLimitExceeded", "storageQuotaExceeded":
+			return "quota"
 		}
+	}
+	switch {
+	case gerr.Code == http.StatusTooManyRequests:
+		// retried like rateLimitExceeded, with or without a reason
+		return "rate-limited"
+	case (sharedWithMe || corpora == "domain") && gerr.Code == http.StatusForbidden:
+		// only the owner can restore a file shared with us
+		return "not-owner"
+	case gerr.Code == http.StatusUnauthorized || gerr.Code == http.StatusForbidden:
+		return "permission"
+	case gerr.Code == http.StatusNotFound:
+		return "not-found"
+	case gerr.Code >= 500 && gerr.Code < 600:
+		return "server"
+	}
+	return "other"
+}
 
-		if recurse && child.MimeType == "application/vnd.google-apps.folder" {
-			err := processFolder(srv, child.Id, child.Title)
-			if err != nil {
-				log.Println("unable to list", child.Title, err)
-				continue
+// scopeError returns the error to abort the run with if err refuses an
+// untrash for the token rather than for the file, as every other one
+// would be refused the same way, or nil.
+func scopeError(err error) error {
+	gerr, ok := googleError(err)
+	if !ok {
+		return nil
+	}
+	how := "delete the cached credential file and run again to authorize"
+	if refreshToken != "" {
+		how = "get a new refresh token with write access to Drive"
+	} else if cacheFile, cerr := tokenCacheFile(); cerr == nil {
+		how = fmt.Sprintf("delete %s and run again to authorize", cacheFile)
+	}
+	switch {
+	case gerr.Code == http.StatusUnauthorized:
+		return codedError{exitAuth, fmt.Errorf("token is invalid or expired, %s: %v", how, err)}
+	case gerr.Code == http.StatusForbidden && len(gerr.Errors) > 0 && gerr.Errors[0].Reason == "insufficientPermissions":
+		// a file we can't write to is insufficientFilePermissions instead
+		return codedError{exitAuth, fmt.Errorf("token lacks write scope, restoring needs the https://www.googleapis.com/auth/drive scope, %s: %v", how, err)}
+	}
+	return nil
+}
+
+// stringsFlag is a flag.Value collecting all the values of a repeatable flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// timeFlag is a flag.Value for a point in time, given as RFC 3339 or as a
+// date.
+type timeFlag struct {
+	time.Time
+}
+
+func (f *timeFlag) String() string {
+	if f.IsZero() {
+		return ""
+	}
+	return f.Format(time.RFC3339)
+}
+
+func (f *timeFlag) Set(value string) error {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", value)
+	}
+	if err != nil {
+		return fmt.Errorf("expected a date like 2006-01-02 or 2006-01-02T15:04:05Z07:00")
+	}
+	f.Time = t
+	return nil
+}
+
+// parseExtensions returns the set of extensions in a comma-separated list
+// like "pdf,.DOCX", lowercased and without the dot.
+func parseExtensions(list string) map[string]bool {
+	exts := map[string]bool{}
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext != "" {
+			exts[ext] = true
+		}
+	}
+	return exts
+}
+
+// extension returns the lowercased extension of title without the dot.
+func extension(title string) string {
+	return strings.ToLower(strings.TrimPrefix(path.Ext(title), "."))
+}
+
+// matchMime reports whether mimeType matches any of the patterns. A pattern
+// ending with a slash, such as "image/", matches the whole type family.
+func matchMime(mimeType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/") {
+			if strings.HasPrefix(mimeType, pattern) {
+				return true
 			}
+		} else if mimeType == pattern {
+			return true
 		}
 	}
+	return false
+}
+
+func isTrashed(f *drive.File) bool {
+	return f.ExplicitlyTrashed || (f.Labels != nil && f.Labels.Trashed)
+}
+
+// startWorkers starts n goroutines executing restores from restoreQueue.
+func startWorkers(n int) {
+	restoreQueue = make(chan func())
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			for {
+				activeWorkers.wait(i)
+				job, ok := <-restoreQueue
+				if !ok {
+					return
+				}
+				job()
+			}
+		}(i)
+	}
 }
 
 func shouldRetry(err error) (bool, error) {
 	switch gerr := err.(type) {
 	case *googleapi.Error:
-		if gerr.Code >= 500 && gerr.Code < 600 {
+		if gerr.Code == http.StatusTooManyRequests {
+			if retryAfter, ok := parseRetryAfter(gerr.Header.Get("Retry-After")); ok {
+				countRateLimited()
+				logWarning("Rate limited with HTTP 429, retrying after %v", retryAfter)
+				logRetry(err)
+				return true, pacer.RetryAfterError(err, retryAfter)
+			}
+			countRateLimited()
+			logWarning("Rate limited with HTTP 429, retrying")
+			logRetry(err)
+			return true, err
+		} else if gerr.Code >= 500 && gerr.Code < 600 {
 			// All 5xx errors should be retried
+			logRetry(err)
 			return true, err
 		} else if len(gerr.Errors) > 0 {
 			reason := gerr.Errors[0].Reason
 			if reason == "rateLimitExceeded" || reason == "userRateLimitExceeded" {
+				countRateLimited()
+				logRetry(err)
+				return true, err
+			}
+			if reason == "dailyLimitExceeded" && pauseOnQuota {
+				pauseForQuota()
 				return true, err
 			}
 		}
+	default:
+		if isTransientNetError(err) {
+			logRetry(err)
+			return true, err
+		}
 	}
 	return false, err
 }
 
-func getFolderPage(srv *drive.Service, folderId string, pageToken string) ([]*drive.File, string, error) {
+// isTransientNetError reports whether err is a connection level error
+// that's likely to go away on retry, like a reset connection or a timeout.
+func isTransientNetError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	// a handshake cut short by the network, the handshake timeout of
+	// net/http is a net.Error already
+	var recordErr tls.RecordHeaderError
+	return errors.As(err, &recordErr)
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is
+// either a number of seconds or an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// googleError finds the *googleapi.Error in err, also looking through the
+// pacer's wrapping of errors to retry after a delay.
+func googleError(err error) (*googleapi.Error, bool) {
+	for err != nil {
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) {
+			return gerr, true
+		}
+		c, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+	return nil, false
+}
+
+// logRetry logs a retried call together with its request ID, if asked to.
+func logRetry(err error) {
+	if logRequestIDs {
+		logWarning("Retrying after error: %s%s", err, requestInfo(err))
+	}
+}
+
+// requestInfo returns a suffix for log messages identifying the failed API
+// request, so it can be handed over to Google support. It is empty unless
+// request ID logging is enabled.
+func requestInfo(err error) string {
+	if !logRequestIDs {
+		return ""
+	}
+	gerr, ok := googleError(err)
+	if !ok || gerr.Header == nil {
+		return ""
+	}
+	if id := gerr.Header.Get("X-Goog-Request-Id"); id != "" {
+		return fmt.Sprintf(" (request ID %s)", id)
+	}
+	// no request ID header, log everything we've got instead
+	return fmt.Sprintf(" (response header %v)", gerr.Header)
+}
+
+// folderQueries returns the queries listing what's needed inside a folder,
+// each paginated on its own: the folders to descend into and the trashed
+// items together, or with -two-phase-listing the folders first and then
+// the trashed items, which include the trashed folders.
+func folderQueries() []string {
+	// with -only-trashed-folders the trashed folders already match
+	// trashed = true
+	var folders string
+	if !onlyTrashedFolders {
+		folders = "mimeType = 'application/vnd.google-apps.folder'"
+	}
+	if followShortcuts {
+		shortcuts := "mimeType = 'application/vnd.google-apps.shortcut'"
+		if folders != "" {
+			folders += " or " + shortcuts
+		} else {
+			folders = shortcuts
+		}
+	}
+	if folders == "" {
+		return []string{"trashed = true"}
+	}
+	if !twoPhaseListing {
+		return []string{folders + " or trashed = true"}
+	}
+	return []string{"(" + folders + ") and trashed = false", "trashed = true"}
+}
+
+// getFolderPage returns a page of the files in folderId matching q, one
+// of folderQueries.
+func getFolderPage(ctx context.Context, srv *drive.Service, folderId string, q string, pageToken string) ([]*drive.File, string, error) {
+	if folderId != "" {
+		q = fmt.Sprintf("'%s' in parents and (%s)", folderId, q)
+	}
+	s := startSpan("list folder")
+	s.set("folder.id", folderId)
+	files, next, err := getPage(withSpan(ctx, s), srv, q, pageToken)
+	s.set("files", len(files))
+	s.finish(err)
+	return files, next, err
+}
+
+// fileFields are the fields fetched for every listed file.
+const fileFields = "id, title, mimeType, fileSize, createdDate, modifiedDate, trashedDate, explicitlyTrashed, labels(trashed), parents(id), owners(emailAddress), trashingUser(emailAddress), md5Checksum, shortcutDetails(targetId, targetMimeType)"
+
+// getPage returns a page of the files matching the query q.
+func getPage(ctx context.Context, srv *drive.Service, q string, pageToken string) ([]*drive.File, string, error) {
 	var (
 		fl  *drive.FileList
 		err error
 	)
 	err = p.Call(func() (bool, error) {
-		call := srv.Files.List().MaxResults(1000).Fields("nextPageToken", "items(id, title, mimeType, explicitlyTrashed)")
-		if folderId != "" {
-			call.Q(fmt.Sprintf("'%s' in parents and (mimeType = 'application/vnd.google-apps.folder' or trashed = true)", folderId))
-		} else {
-			call.Q("mimeType = 'application/vnd.google-apps.folder' or trashed = true")
+		if !spendCall() {
+			return false, errBudgetExhausted
+		}
+		spanFrom(ctx).attempt()
+		defer apiCalls.time("list")()
+		call := srv.Files.List().MaxResults(1000).Fields("nextPageToken", "items("+fileFields+")")
+		call.Q(q)
+		if corpora != "" {
+			call.Corpora(corpora).SupportsAllDrives(true).IncludeItemsFromAllDrives(true)
+			if driveID != "" {
+				call.DriveId(driveID)
+			}
 		}
 		if pageToken != "" {
 			call.PageToken(pageToken)
 		}
-		fl, err = call.Do()
+		fl, err = call.Context(ctx).Do()
 		return shouldRetry(err)
 	})
-	if err != nil {
-		return nil, "", fmt.Errorf("Unable to retrieve files: %v", err)
+	if err == errBudgetExhausted {
+		return nil, "", err
+	} else if err != nil {
+		return nil, "", fmt.Errorf("Unable to retrieve files: %v%s", err, requestInfo(err))
 	}
 
 	return fl.Items, fl.NextPageToken, nil
 }
 
-var seen = map[string]int{}
-var seenMutex sync.Mutex
+// dumpFolders prints the folder tree below folderID, indented by depth and
+// with the number of trashed items directly inside each folder.
+func dumpFolders(ctx context.Context, srv *drive.Service, folderID string, folderTitle string, depth int, listed map[string]bool) error {
+	indent := strings.Repeat("  ", depth)
+	if listed[folderID] {
+		fmt.Printf("%s%s (%s) [already listed]\n", indent, folderTitle, folderID)
+		return nil
+	}
+	listed[folderID] = true
+
+	var (
+		folders []*drive.File
+		trashed int
+	)
+	for _, q := range folderQueries() {
+		var pageToken string
+		for {
+			files, next, err := getFolderPage(ctx, srv, folderID, q, pageToken)
+			if err != nil {
+				return fmt.Errorf("Failed to get file listing: %w", err)
+			}
+			for _, f := range files {
+				if f.ExplicitlyTrashed {
+					trashed++
+				}
+				if f.MimeType == "application/vnd.google-apps.folder" {
+					folders = append(folders, f)
+				}
+			}
+			pageToken = next
+			if pageToken == "" {
+				break
+			}
+		}
+	}
+
+	if trashed > 0 {
+		fmt.Printf("%s%s (%s) [%d trashed]\n", indent, folderTitle, folderID, trashed)
+	} else {
+		fmt.Printf("%s%s (%s)\n", indent, folderTitle, folderID)
+	}
+	for _, f := range folders {
+		err := dumpFolders(ctx, srv, f.Id, f.Title, depth+1, listed)
+		if err != nil {
+			logError("unable to list %v %v", f.Title, err)
+		}
+	}
+	return nil
+}
+
+// fatalf logs the error and exits, notifying the webhook about the failed
+// run first. r is nil if the run didn't start yet.
+func fatalf(r *restorer, format string, v ...interface{}) {
+	fatalCode(r, exitError, format, v...)
+}
+
+// fatalCode is fatalf exiting with code.
+func fatalCode(r *restorer, code int, format string, v ...interface{}) {
+	s := &summary{RunID: runID, DryRun: dryRun}
+	if r != nil {
+		r.wait()
+		s = r.summary()
+	}
+	s.Error = fmt.Sprintf(format, v...)
+	events.close()
+	metadataDump.close()
+	restoredIDs.close()
+	notifyWebhook(s)
+	logCritical(s.Error)
+	exit(code)
+}
+
+// exit waits for the milestone webhooks in flight, sends what's left of the
+// traces and of the Cloud Logging buffer and exits with code. main doesn't defer the closing, os.Exit skips deferred
+// calls.
+func exit(code int) {
+	milestoneWebhooks.Wait()
+	closeTracing()
+	closeCloudLogging()
+	os.Exit(code)
+}
+
+// hiddenFlags are left out of the usage, they're only meant for testing.
+var hiddenFlags = map[string]bool{
+	"simulate-failure-rate": true,
+}
 
-func processFolder(srv *drive.Service, folderId string, folderTitle string) error {
-	seenMutex.Lock()
-	count := seen[folderId]
-	seen[folderId]++
-	seenMutex.Unlock()
-	if count > 0 {
-		if verbose {
-			log.Printf("Not processing folder ID \"%s\", already seen %d times, with name \"%s\"", folderId, count, folderTitle)
+// usage is flag.Usage without the hidden flags.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	visible := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	visible.SetOutput(out)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			visible.Var(f.Value, f.Name, f.Usage)
+			visible.Lookup(f.Name).DefValue = f.DefValue
 		}
+	})
+	visible.PrintDefaults()
+}
+
+// simulatedFailure returns a synthetic error for a fraction of the calls
+// given by -simulate-failure-rate, half of them retryable.
+func simulatedFailure() error {
+	if simulateFailureRate <= 0 || rand.Float64() >= simulateFailureRate {
 		return nil
 	}
-	atomic.AddUint64(&countFolders, 1)
-	if verbose {
-		log.Printf("Processing folder ID \"%s\", seen %d times, with name \"%s\"", folderId, count, folderTitle)
+	if rand.Intn(2) == 0 {
+		return &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "simulated failure"}
 	}
-	var pageToken string
-	for {
-		var files []*drive.File
+	return &googleapi.Error{
+		Code:    http.StatusForbidden,
+		Message: "simulated failure",
+		Errors:  []googleapi.ErrorItem{{Reason: "forbidden", Message: "simulated failure"}},
+	}
+}
+
+// resolveAlias maps the names of the My Drive root folder to Drive's
+// "root" alias, which the API resolves to the actual folder ID.
+func resolveAlias(folderID string) string {
+	switch strings.ToLower(folderID) {
+	case "root", "my drive":
+		return "root"
+	}
+	return folderID
+}
+
+// checkQuota logs the free storage quota, warning if restoring size bytes
+// wouldn't fit in it. Files in the trash may already count towards the
+// quota, so this errs on the side of warning.
+func checkQuota(ctx context.Context, srv *drive.Service, size int64) {
+	var about *drive.About
+	err := p.Call(func() (bool, error) {
+		defer apiCalls.time("about")()
 		var err error
-		files, pageToken, err = getFolderPage(srv, folderId, pageToken)
+		about, err = srv.About.Get().Fields("quotaType, quotaBytesTotal, quotaBytesUsedAggregate").Context(ctx).Do()
+		return shouldRetry(err)
+	})
+	if err != nil {
+		logError("Unable to get the storage quota: %v%s", err, requestInfo(err))
+		return
+	}
+	if about.QuotaType == "UNLIMITED" {
+		log.Printf("Storage quota is unlimited")
+		return
+	}
+	free := about.QuotaBytesTotal - about.QuotaBytesUsedAggregate
+	log.Printf("Storage quota has %s free of %s", formatBytes(free), formatBytes(about.QuotaBytesTotal))
+	if size > free {
+		log.Printf("Restoring %s may not fit in the %s of free storage quota", formatBytes(size), formatBytes(free))
+	}
+}
+
+// mergeFolderIDs returns the folder IDs from the comma-separated list and
+// the arguments, without duplicates. Either can have web URLs instead of
+// IDs.
+func mergeFolderIDs(list string, args []string) ([]string, error) {
+	ids := args
+	if list != "" {
+		ids = append(strings.Split(list, ","), args...)
+	}
+	seen := map[string]bool{}
+	var merged []string
+	for _, id := range ids {
+		id, err := parseID(strings.TrimSpace(id))
 		if err != nil {
-			return fmt.Errorf("Failed to get file listing: %w", err)
-		}
-		wg.Add(1)
-		go func(srv *drive.Service, folderId string, files []*drive.File) {
-			restoreTrashed(srv, folderId, files, true)
-			wg.Done()
-		}(srv, folderId, files)
-		// end of listing, that was last page
-		if pageToken == "" {
-			break
+			return nil, err
+		}
+		if id == "" || seen[id] {
+			continue
 		}
+		seen[id] = true
+		merged = append(merged, id)
 	}
-	return nil
+	return merged, nil
+}
+
+// account is the email address of the authenticated user, set by
+// checkAccess.
+var account string
+
+// checkAccess verifies that the client is authenticated and that all the
+// given folders are reachable, so that problems show up before the walk.
+// It returns the metadata of the folders.
+func checkAccess(srv *drive.Service, folderIDs []string) ([]*drive.File, error) {
+	var about *drive.About
+	err := p.Call(func() (bool, error) {
+		defer apiCalls.time("about")()
+		var err error
+		about, err = srv.About.Get().Fields("user(emailAddress)").Do()
+		return shouldRetry(err)
+	})
+	if err != nil {
+		if gerr, ok := googleError(err); ok {
+			switch gerr.Code {
+			case http.StatusUnauthorized:
+				return nil, codedError{exitAuth, fmt.Errorf("token is invalid or expired, delete the cached credential file and authorize again: %v", err)}
+			case http.StatusForbidden:
+				return nil, codedError{exitAuth, fmt.Errorf("token lacks the required scope, delete the cached credential file and authorize again: %v", err)}
+			}
+		}
+		return nil, fmt.Errorf("unable to access Drive: %v%s", err, requestInfo(err))
+	}
+	log.Printf("Authenticated as %s", about.User.EmailAddress)
+	account = about.User.EmailAddress
+	return checkFolders(srv, folderIDs)
+}
+
+// checkFolders returns the metadata of the given folders, failing if one
+// of them isn't reachable or isn't a folder.
+func checkFolders(srv *drive.Service, folderIDs []string) ([]*drive.File, error) {
+	var folders []*drive.File
+	for _, folderID := range folderIDs {
+		folderID := resolveAlias(folderID)
+		var f *drive.File
+		err := p.Call(func() (bool, error) {
+			defer apiCalls.time("get")()
+			var err error
+			f, err = srv.Files.Get(folderID).SupportsAllDrives(true).Fields("id, title, mimeType, explicitlyTrashed, labels(trashed)").Do()
+			return shouldRetry(err)
+		})
+		if err != nil {
+			return nil, codedError{exitNoAccess, fmt.Errorf("unable to access folder %q: %v%s", folderID, err, requestInfo(err))}
+		}
+		if f.MimeType != "application/vnd.google-apps.folder" {
+			return nil, fmt.Errorf("%q (%s) is not a folder", folderID, f.Title)
+		}
+		if verbose && f.Id != folderID {
+			log.Printf("Resolved %q to folder ID %q", folderID, f.Id)
+		}
+		folders = append(folders, f)
+	}
+	return folders, nil
 }
 
 // getClient uses a Context and Config to retrieve a Token
 // then generate a Client. It returns the generated Client.
 func getClient(ctx context.Context, config *oauth2.Config) *http.Client {
+	if refreshToken != "" {
+		// the access token is fetched with the refresh token on first use
+		return config.Client(ctx, &oauth2.Token{RefreshToken: refreshToken})
+	}
 	cacheFile, err := tokenCacheFile()
 	if err != nil {
-		log.Fatalf("Unable to get path to cached credential file. %v", err)
+		fatalf(nil, "Unable to get path to cached credential file. %v", err)
 	}
-	tok, err := tokenFromFile(cacheFile)
+	tok, err := cachedToken(cacheFile)
 	if err != nil {
+		fatalf(nil, "Unable to read cached credential file: %v", err)
+	}
+	if tok == nil {
 		tok = getTokenFromWeb(config)
 		saveToken(cacheFile, tok)
 	}
 	return config.Client(ctx, tok)
 }
 
+// cachedToken returns the token cached in file, or nil if there's none and
+// the user has to authorize again. A corrupt file is moved out of the way,
+// while the errors reading it are returned.
+func cachedToken(file string) (*oauth2.Token, error) {
+	tok, err := tokenFromFile(file)
+	var corrupt corruptTokenError
+	switch {
+	case err == nil:
+		return tok, nil
+	case os.IsNotExist(err):
+		return nil, nil
+	case errors.As(err, &corrupt):
+		// keep the broken file around for inspection instead of
+		// silently overwriting it
+		backup := file + ".corrupt"
+		log.Printf("Cached credential file %s is corrupt (%v), moving it to %s and authorizing again", file, err, backup)
+		if err := os.Rename(file, backup); err != nil {
+			logError("Unable to back up corrupt credential file: %v", err)
+		}
+		return nil, nil
+	}
+	return nil, err
+}
+
+// corruptTokenError is returned by tokenFromFile for a file that was read
+// but doesn't hold a token.
+type corruptTokenError struct {
+	err error
+}
+
+func (e corruptTokenError) Error() string { return e.err.Error() }
+
 // getTokenFromWeb uses Config to request a Token.
 // It returns the retrieved Token.
 func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
@@ -173,12 +794,12 @@ func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
 
 	var code string
 	if _, err := fmt.Scan(&code); err != nil {
-		log.Fatalf("Unable to read authorization code %v", err)
+		fatalf(nil, "Unable to read authorization code %v", err)
 	}
 
 	tok, err := config.Exchange(context.Background(), code)
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web %v", err)
+		fatalf(nil, "Unable to retrieve token from web %v", err)
 	}
 	return tok
 }
@@ -186,20 +807,44 @@ func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
 // tokenCacheFile generates credential file path/filename.
 // It returns the generated credential path/filename.
 func tokenCacheFile() (string, error) {
-	return url.QueryEscape("drive-go-quickstart.json"), nil
+	name := "drive-go-quickstart"
+	if profile != "" {
+		name += "-" + profile
+	}
+	// the read-only token is kept apart, so that it never has more scope
+	if readOnly {
+		name += "-readonly"
+	}
+	return url.QueryEscape(name + ".json"), nil
+}
+
+// clientSecretFile returns the path of the client secret file, -client-secret
+// taking precedence over the one of the profile.
+func clientSecretFile() string {
+	if clientSecretPath != "" {
+		return clientSecretPath
+	}
+	if profile != "" {
+		return url.QueryEscape(fmt.Sprintf("client_secret-%s.json", profile))
+	}
+	return "client_secret.json"
 }
 
 // tokenFromFile retrieves a Token from a given file path.
 // It returns the retrieved Token and any read error encountered.
 func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
+	b, err := ioutil.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
 	t := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(t)
-	defer f.Close()
-	return t, err
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, corruptTokenError{err}
+	}
+	if t.AccessToken == "" && t.RefreshToken == "" {
+		return nil, corruptTokenError{errors.New("no token found")}
+	}
+	return t, nil
 }
 
 // saveToken uses a file path to create a file and store the
@@ -209,62 +854,626 @@ func saveToken(file string, token *oauth2.Token) {
 
 	data, err := json.Marshal(token)
 	if err != nil {
-		log.Fatalf("Failed to marshal token into json: %s", err)
+		fatalf(nil, "Failed to marshal token into json: %s", err)
 	}
 
 	err = ioutil.WriteFile(file, data, 0600)
 	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+		fatalf(nil, "Unable to cache oauth token: %v", err)
 	}
 }
 
 func main() {
 	go func() {
-		log.Println(http.ListenAndServe("localhost:6060", nil))
+		logError("%v", http.ListenAndServe("localhost:6060", nil))
 	}()
 	fs.Config.LogLevel = fs.LogLevelDebug
-	p = pacer.New()
+	p = &retryPacer{pacer.New()}
 	p.SetCalculator(pacer.NewDefault())
-	p.SetRetries(50)
 	p.SetMaxConnections(100)
 	ctx := context.Background()
 
 	flag.BoolVar(&verbose, "v", false, "verbose logging")
+	flag.BoolVar(&logRequestIDs, "request-ids", false, "log Drive API request IDs of failed calls")
+	flag.IntVar(&workers, "workers", 100, "number of concurrent restores")
+	flag.IntVar(&folderWorkersMax, "concurrency-per-folder", 20, "maximum number of concurrent restores within a single folder")
+	flag.Var(&excludeMime, "exclude-mime", "don't restore files of this MIME type, or type family if ending with a slash (repeatable)")
+	flag.BoolVar(&dumpFolderTree, "dump-folders", false, "print the folder tree with the number of trashed items in each folder, don't restore anything")
+	flag.BoolVar(&rootsOnly, "roots-only", false, "only restore trashed items whose parent isn't trashed, don't look inside trashed folders")
+	flag.BoolVar(&dryRun, "dry-run", false, "only log what would be restored")
+	flag.IntVar(&dryRunSample, "dry-run-sample", 0, "in dry-run mode, log only a random sample of this many files")
+	flag.BoolVar(&flat, "flat", false, "restore everything in the trash using a single listing instead of walking the folders")
+	flag.IntVar(&largestFirst, "largest-first", 0, "in -flat mode, restore only this many of the largest files (keeps the whole trash listing in memory)")
+	flag.StringVar(&webhookURL, "webhook-url", "", "POST the JSON summary to this URL when the run finishes")
+	flag.BoolVar(&bfs, "bfs", false, "walk the folders breadth-first, level by level")
+	flag.BoolVar(&verifyMetadata, "verify-metadata", false, "warn if restoring a file changed its modified time")
+	flag.Uint64Var(&maxAPICalls, "max-api-calls", 0, "stop once this many list and restore calls were made, 0 for no limit")
+	flag.Var(&folderCutoff, "folder-modified-after", "don't look into folders last modified before this date, this may miss trashed files in them")
+	flag.StringVar(&jsonlPath, "jsonl", "", "write every restore as a JSON line to this file as it happens, - for stdout")
+	flag.IntVar(&jsonlBatchSize, "jsonl-batch-size", 1, "flush the -jsonl output every this many events")
+	flag.DurationVar(&jsonlFlushEvery, "jsonl-flush-interval", time.Second, "flush the -jsonl output at least this often")
+	flag.BoolVar(&trashedFolderNoRecurse, "trashed-folder-no-recurse", false, "restore trashed folders without looking inside them, implied by -roots-only")
+	flag.DurationVar(&folderTimeout, "max-runtime-per-folder", 0, "abandon the rest of a folder once it's been processed for this long, not counting the time spent waiting for a free worker, 0 for no limit")
+	flag.StringVar(&serveAddr, "serve", "", "serve an HTTP API for restores on this address instead of restoring the folders given; without -serve-token only on a loopback address like localhost:8080")
+	flag.StringVar(&serveToken, "serve-token", "", "with -serve, require this bearer token in the Authorization header of the requests, $DRIVE_UNTRASH_SERVE_TOKEN if not given")
+	flag.StringVar(&profile, "profile", "", "use the client secret and credentials of this profile, to switch between accounts and apps")
+	flag.StringVar(&clientSecretPath, "client-secret", "", "path to the client secret file, overriding the one of the profile")
+	flag.IntVar(&reconcileAttempts, "reconcile", 0, "restore the whole trash and check it again, up to this many times until it stays empty of the files the filters restore")
+	flag.StringVar(&logFile, "log-file", "", "write the log to this file instead of stderr")
+	flag.IntVar(&logMaxSize, "log-max-size", 100, "rotate the -log-file once it reaches this many megabytes")
+	flag.IntVar(&logMaxBackups, "log-max-backups", 3, "number of rotated -log-file backups to keep")
+	flag.Float64Var(&simulateFailureRate, "simulate-failure-rate", 0, "fail this fraction of restore calls with synthetic errors, for testing")
+	flag.Usage = usage
+	flag.StringVar(&wasInParent, "was-in-parent", "", "only restore files that have this folder ID among their parents, wherever the walk finds them")
+	flag.BoolVar(&listExpiringMode, "list-expiring", false, "list the items that are in the trash for long enough to be purged soon as CSV, don't restore anything")
+	flag.IntVar(&expiringDays, "expiring-days", 25, "with -list-expiring, list the items trashed at least this many days ago")
+	flag.DurationVar(&minTrashedAge, "trashed-before-age", 0, "leave files trashed less than this long ago alone, to not fight with a sync in progress")
+	flag.BoolVar(&verifyRevisions, "verify-revisions", false, "warn if restoring a file lost some of its revisions, counting them before and after")
+	flag.BoolVar(&recoveryFolder, "recovery-folder", false, "move the restored files into a new folder named after the time of the run")
+	flag.BoolVar(&refetchPartial, "refetch-partial", false, "get the metadata of listed files that are missing fields needed to handle them")
+	flag.BoolVar(&listOwnersMode, "list-owners", false, "print the number of trashed items per owner, don't restore anything")
+	flag.StringVar(&userAgent, "user-agent", "drive-untrash/"+version, "User-Agent to identify the Drive API requests with")
+	flag.StringVar(&metadataDumpPath, "metadata-dump", "", "append the full metadata of every restored file as JSON lines to this file, getting it takes an extra API call per file")
+	flag.BoolVar(&pauseOnQuota, "pause-on-quota", false, "when the daily quota is exceeded, sleep until it resets at midnight Pacific time and carry on; with -control-file, the folders finished are checkpointed for -resume before sleeping")
+	flag.BoolVar(&restoreParents, "restore-parents", false, "restore the trashed folders above the restored files too, so that they're not left in the trash")
+	flag.BoolVar(&skipIfExists, "skip-if-exists", false, "don't restore files when a file with the same name is in their folder outside the trash")
+	flag.BoolVar(&skipIfExistsMd5, "skip-if-exists-md5", false, "with -skip-if-exists, only when that file has the same MD5 checksum too")
+	flag.Uint64Var(&milestone, "milestone", 0, "log the progress every this many restored files, and send it to the webhook")
+	flag.BoolVar(&readOnly, "read-only", false, "implies -dry-run, and makes sure nothing gets modified by using a read-only token and refusing all modifying requests")
+	flag.StringVar(&foldersList, "folders", "", "comma-separated IDs of the folders to restore, in addition to the ones given as arguments")
+	flag.BoolVar(&trashedCount, "trashed-count", false, "count the trashed items before starting, to know how big the job is, which takes a listing of the whole trash")
+	flag.BoolVar(&sharedWithMe, "shared-with-me", false, "restore the trashed files shared with you instead of the ones in your drive, which may need their owner to restore them")
+	flag.StringVar(&runID, "run-id", "", "prefix the log lines and tag the events and summary with this, to grep a run out of a shared log (default the start time and process ID)")
+	flag.IntVar(&listWorkers, "list-workers", 0, "at most this many goroutines listing folders, independently of -workers, 0 for no limit, or with -bfs -workers folders at a time")
+	flag.StringVar(&planOut, "plan-out", "", "implies -dry-run, and writes the IDs of the files that would be restored to this file, along with when they were trashed and modified")
+	flag.StringVar(&planIn, "plan-in", "", "restore exactly the files in this plan written by -plan-out, one at a time in its order, without walking the folders or filtering them again; files changed since the plan was made are left alone")
+	flag.DurationVar(&startJitter, "start-jitter", 0, "wait a random time up to this long before the first API call, to spread out instances started at once")
+	flag.StringVar(&refreshToken, "refresh-token", "", "authorize with this OAuth refresh token instead of the cached credential file or the web flow, $DRIVE_UNTRASH_REFRESH_TOKEN if not given")
+	flag.BoolVar(&followShortcuts, "follow-shortcuts", false, "walk into the folders that shortcuts point to as well")
+	flag.Var(&createdAfter, "created-after", "only restore files created after this date")
+	flag.Var(&createdBefore, "created-before", "only restore files created before this date")
+	flag.BoolVar(&dryRunByFolder, "dry-run-by-folder", false, "with -dry-run, log the files that would be restored grouped by the folder they'd reappear in")
+	flag.StringVar(&includeExtList, "ext", "", "only restore files with one of these comma-separated extensions, like pdf,docx")
+	flag.StringVar(&excludeExtList, "exclude-ext", "", "don't restore files with one of these comma-separated extensions")
+	flag.StringVar(&cloudLoggingProject, "cloud-logging", "", "send the log and the events to Cloud Logging in this project ID, authenticating with the application default credentials")
+	flag.BoolVar(&finalVerifyMode, "final-verify", false, "list the whole trash after the run, failing if files that should have been restored are still in it")
+	flag.IntVar(&maxParentsDepth, "max-parents-depth", 100, "give up walking up the parents of a file after this many folders, in case they loop")
+	flag.DurationVar(&progressEvery, "progress", 0, "show the totals this often, on a single line updated in place if stderr is a terminal")
+	flag.BoolVar(&skipOrphans, "skip-orphans", false, "don't restore files whose parents are all trashed or gone, and list them at the end")
+	flag.StringVar(&corpora, "corpora", "", "list the files in these groupings: user for My Drive, drive for the shared drive of -drive-id, allDrives for My Drive and all the shared drives, domain for the files shared to your Workspace domain (default user)")
+	flag.StringVar(&driveID, "drive-id", "", "with -corpora drive, the ID of the shared drive to list, which is walked from its top if no folders are given")
+	flag.BoolVar(&benchmarkListMode, "benchmark-list", false, "list the folders without restoring anything, and log how many items and API calls per second that took, with -list-workers or else -workers listings at a time")
+	flag.BoolVar(&verifyChecksum, "verify-checksum", false, "fetch each restored file again and warn if its md5Checksum isn't the one it was listed with")
+	flag.BoolVar(&onlyTrashedFolders, "only-trashed-folders", false, "only descend into folders that are trashed themselves, not listing the rest of the tree")
+	flag.IntVar(&memLimit, "mem-limit", 0, "stop listing new pages while the heap is above this many megabytes, until the restores in flight bring it down (default no limit)")
+	flag.StringVar(&trashedBy, "trashed-by", "", "only restore files trashed by the user with this email address, which Drive only records in shared drives")
+	flag.StringVar(&otelEndpoint, "otel-endpoint", "", "send OpenTelemetry traces of the folder listings and restores to this OTLP/HTTP collector, like http://localhost:4318")
+	flag.BoolVar(&twoPhaseListing, "two-phase-listing", false, "list the folders and the trashed items of each folder with separate queries, which can be faster on folders with a lot in the trash; compare with -benchmark-list")
+	flag.StringVar(&reportFieldList, "report-fields", "", "only write these comma-separated fields of each -jsonl record, out of "+strings.Join(eventFields, ",")+" (default all of them)")
+	flag.StringVar(&restoredIDsDir, "restored-ids-dir", "", "keep the IDs of the restored files in this directory, one set per user, and don't restore the files of the set again in later runs")
+	flag.StringVar(&afterRestoreHook, "after-restore-hook", "", "run this command after each restore, with the file ID and title as arguments and as DRIVE_UNTRASH_FILE_ID, DRIVE_UNTRASH_FILE_TITLE and DRIVE_UNTRASH_FOLDER_ID in the environment; its failures are only logged")
+	flag.DurationVar(&afterRestoreHookTimeout, "after-restore-hook-timeout", time.Minute, "kill the -after-restore-hook command if it runs for longer than this")
+	flag.IntVar(&afterRestoreHookJobs, "after-restore-hook-jobs", 4, "run at most this many -after-restore-hook commands at once")
+	flag.StringVar(&restoreOrder, "restore-order", "none", "restore by trashed time, fifo for the oldest first or lifo for the newest first; the restores then wait for the end of the walk and run one at a time")
+	flag.Float64Var(&samplePercent, "sample-percent", 100, "only restore this percentage of the matching files, picked by their ID so that a later run with a higher percentage restores the same files and more")
+	flag.BoolVar(&tagRestored, "tag-restored", false, "set the private properties restoredBy=drive-untrash, restoredAt and restoredRun on each restored file, to find them in Drive later")
+	flag.BoolVar(&listDuplicatesMode, "list-duplicates", false, "print the trashed files as CSV grouped with their trashed duplicates, of the same checksum or else the same title and size, don't restore anything")
+	flag.StringVar(&dedupRestore, "dedup-restore", "", "with keep-newest, of the trashed files that have the same checksum, or else the same title and size, only restore the most recently modified one that passes the other filters and is in the folders restored; the whole trash is listed first to find them")
+	flag.BoolVar(&streamMode, "stream", false, "write each trashed item to stdout as a JSON line as soon as it's listed, don't restore anything; the log stays on stderr")
+	flag.StringVar(&flattenTo, "flatten-to", "", "move the restored files into this folder, named after the folders they were in like Projects__2023__report.xlsx")
+	flag.IntVar(&retries5xx, "retries-5xx", 50, "retry a call at most this many times for 5xx server errors")
+	flag.IntVar(&retriesRateLimit, "retries-ratelimit", 50, "retry a call at most this many times for rate limit errors")
+	flag.IntVar(&retriesNetwork, "retries-network", 50, "retry a call at most this many times for network errors, like a reset connection or a timeout")
+	flag.StringVar(&controlFile, "control-file", "", "check this file every second: pause stops starting new restores and listings, resume continues, and stop lets the restores in flight finish and ends the run, writing the folders finished to <file>.checkpoint for -resume, as does running out of -max-api-calls; the -max-runtime-per-folder clock stops while paused")
+	flag.StringVar(&sharedDriveTrash, "shared-drive-trash", "", "restore the whole trash of the shared drive with this ID, like -flat does for My Drive; it takes a manager or content manager of the drive")
+	flag.BoolVar(&concurrencyAuto, "concurrency-auto", false, "start with a single restore worker and add one every 10 seconds without rate limiting, up to -workers, halving them when rate limited")
+	flag.StringVar(&sheetOutput, "sheet-output", "", "write the summary of the run to a new Google Sheet with this title in your drive")
+	flag.BoolVar(&sheetFiles, "sheet-files", false, "with -sheet-output, also list the files restored, or that would be, and the failed ones")
+	flag.DurationVar(&rampDuration, "ramp-duration", 0, "start with a single restore worker and add more evenly over this long, up to -workers")
+	flag.Int64Var(&sizeBudget, "size-budget", 0, "only restore files totaling up to this many megabytes, in the -size-budget-order; the restores then wait for the end of the walk")
+	flag.StringVar(&sizeBudgetOrder, "size-budget-order", "smallest", "with -size-budget, restore the smallest or the largest files first")
+	flag.StringVar(&resumeFrom, "resume", "", "skip the folders finished according to this checkpoint, written when -control-file says stop or -max-api-calls runs out")
+	flag.DurationVar(&rateLimitBackoffBase, "ratelimit-backoff", 2*time.Second, "wait this long before retrying a rate limited call that didn't say how long to wait, doubling with each retry up to a minute, 0 for the pacer's usual backoff")
 	flag.Parse()
 
-	b, err := ioutil.ReadFile("client_secret.json")
+	if refreshToken == "" {
+		// not the flag default, which would show it in the usage
+		refreshToken = os.Getenv("DRIVE_UNTRASH_REFRESH_TOKEN")
+	}
+	if serveToken == "" {
+		serveToken = os.Getenv("DRIVE_UNTRASH_SERVE_TOKEN")
+	}
+	if readOnly || planOut != "" {
+		dryRun = true
+	}
+	folderIDs, err := mergeFolderIDs(foldersList, flag.Args())
+	if err != nil {
+		log.Fatalf("Invalid folder: %v", err)
+	}
+	if flattenTo, err = parseID(flattenTo); err != nil {
+		log.Fatalf("Invalid -flatten-to folder: %v", err)
+	}
+	if flattenTo != "" && recoveryFolder {
+		log.Fatalf("-flatten-to can't be combined with -recovery-folder")
+	}
+	includeExt = parseExtensions(includeExtList)
+	excludeExt = parseExtensions(excludeExtList)
+	if err := validateFilters(); err != nil {
+		log.Fatalf("Invalid filter: %v", err)
+	}
+
+	if logFile != "" {
+		log.SetOutput(&lumberjack.Logger{
+			Filename:   logFile,
+			MaxSize:    logMaxSize,
+			MaxBackups: logMaxBackups,
+		})
+	}
+	if cloudLoggingProject != "" {
+		if err := openCloudLogging(ctx, cloudLoggingProject); err != nil {
+			log.Fatalf("Unable to set up Cloud Logging: %v", err)
+		}
+	}
+	if runID == "" {
+		runID = fmt.Sprintf("%s-%d", time.Now().UTC().Format("20060102T150405"), os.Getpid())
+	}
+	log.SetPrefix("[" + runID + "] ")
+	if otelEndpoint != "" {
+		if err := openTracing(otelEndpoint); err != nil {
+			fatalf(nil, "Unable to set up tracing: %v", err)
+		}
+	}
+	log.Printf("Looking for %s", describeFilters())
+	if jsonlBatchSize < 1 || jsonlFlushEvery <= 0 {
+		fatalf(nil, "-jsonl-batch-size and -jsonl-flush-interval must be positive")
+	}
+	if workers < 1 || folderWorkersMax < 1 {
+		fatalf(nil, "-workers and -concurrency-per-folder must be at least 1")
+	}
+	if afterRestoreHook != "" {
+		if afterRestoreHookJobs < 1 || afterRestoreHookTimeout <= 0 {
+			fatalf(nil, "-after-restore-hook-jobs and -after-restore-hook-timeout must be positive")
+		}
+		hooks = startHooks(afterRestoreHookJobs)
+	}
+	if rampDuration < 0 {
+		fatalf(nil, "-ramp-duration must not be negative")
+	}
+	if rampDuration > 0 && concurrencyAuto {
+		fatalf(nil, "-ramp-duration can't be combined with -concurrency-auto, which starts slow already")
+	}
+	if sheetFiles && sheetOutput == "" {
+		fatalf(nil, "-sheet-files requires -sheet-output")
+	}
+	if sheetOutput != "" && readOnly {
+		fatalf(nil, "-sheet-output creates a spreadsheet, it can't be combined with -read-only")
+	}
+	if sharedDriveTrash != "" {
+		if corpora != "" || driveID != "" {
+			fatalf(nil, "-shared-drive-trash can't be combined with -corpora or -drive-id")
+		}
+		id, err := parseID(sharedDriveTrash)
+		if err != nil {
+			fatalf(nil, "Invalid -shared-drive-trash: %v", err)
+		}
+		// the trash of a shared drive is the flat listing of its trashed
+		// files
+		flat, corpora, driveID = true, "drive", id
+	}
+	if serveAddr != "" && serveToken == "" && !isLoopback(serveAddr) {
+		fatalf(nil, "-serve on %s takes restores on your account from other hosts, give a -serve-token or serve on localhost", serveAddr)
+	}
+	if serveAddr != "" && (len(folderIDs) > 0 || flat || bfs || dumpFolderTree) {
+		fatalf(nil, "-serve takes the folders to restore over HTTP, it can't be combined with folder IDs, -flat, -bfs or -dump-folders")
+	}
+	if flat && (len(folderIDs) > 0 || dumpFolderTree || bfs) {
+		fatalf(nil, "-flat restores the whole trash, it can't be combined with folder IDs, -dump-folders or -bfs")
+	}
+	if reconcileAttempts > 0 && (len(folderIDs) > 0 || flat || bfs || dumpFolderTree || dryRun) {
+		fatalf(nil, "-reconcile restores the whole trash, it can't be combined with folder IDs, -flat, -bfs, -dump-folders or -dry-run")
+	}
+	if streamMode && jsonlPath == "-" {
+		fatalf(nil, "-stream writes to stdout, -jsonl can't too")
+	}
+	if retries5xx < 0 || retriesRateLimit < 0 || retriesNetwork < 0 {
+		fatalf(nil, "-retries-5xx, -retries-ratelimit and -retries-network can't be negative")
+	}
+	if rateLimitBackoffBase < 0 {
+		fatalf(nil, "-ratelimit-backoff can't be negative")
+	}
+	p.SetRetries(retries5xx + retriesRateLimit + retriesNetwork + extraPacerRetries)
+	if samplePercent <= 0 || samplePercent > 100 {
+		fatalf(nil, "-sample-percent must be above 0 and at most 100")
+	}
+	if dedupRestore != "" && dedupRestore != "keep-newest" {
+		fatalf(nil, "-dedup-restore must be keep-newest")
+	}
+	switch restoreOrder {
+	case "none", "fifo", "lifo":
+	default:
+		fatalf(nil, "-restore-order must be none, fifo or lifo")
+	}
+	if restoreOrder != "none" && (reconcileAttempts > 0 || serveAddr != "") {
+		fatalf(nil, "-restore-order can't be combined with -reconcile or -serve")
+	}
+	if sizeBudget < 0 {
+		fatalf(nil, "-size-budget must not be negative")
+	}
+	switch sizeBudgetOrder {
+	case "smallest", "largest":
+	default:
+		fatalf(nil, "-size-budget-order must be smallest or largest")
+	}
+	if sizeBudget > 0 && (restoreOrder != "none" || reconcileAttempts > 0 || serveAddr != "") {
+		fatalf(nil, "-size-budget can't be combined with -restore-order, -reconcile or -serve")
+	}
+	if sharedWithMe && (len(folderIDs) > 0 || flat || bfs || dumpFolderTree || reconcileAttempts > 0 || serveAddr != "") {
+		fatalf(nil, "-shared-with-me can't be combined with folder IDs, -flat, -bfs, -dump-folders, -reconcile or -serve")
+	}
+	if resumeFrom != "" && (flat || sharedWithMe || planIn != "" || reconcileAttempts > 0 || serveAddr != "") {
+		fatalf(nil, "-resume can't be combined with -flat, -shared-with-me, -plan-in, -reconcile or -serve, which don't walk the folders")
+	}
+	if planIn != "" && (planOut != "" || len(folderIDs) > 0 || flat || bfs || sharedWithMe || dumpFolderTree || reconcileAttempts > 0 || serveAddr != "") {
+		fatalf(nil, "-plan-in restores the files in the plan, it can't be combined with -plan-out, folder IDs, -flat, -bfs, -shared-with-me, -dump-folders, -reconcile or -serve")
+	}
+	if largestFirst > 0 && !flat {
+		fatalf(nil, "-largest-first requires -flat")
+	}
+	if onlyTrashedFolders && (rootsOnly || trashedFolderNoRecurse) {
+		fatalf(nil, "-only-trashed-folders can't be combined with -roots-only or -trashed-folder-no-recurse")
+	}
+	if skipIfExistsMd5 && !skipIfExists {
+		fatalf(nil, "-skip-if-exists-md5 requires -skip-if-exists")
+	}
+	switch corpora {
+	case "", "user", "allDrives", "domain":
+		if driveID != "" {
+			fatalf(nil, "-drive-id requires -corpora drive")
+		}
+	case "drive":
+		if driveID == "" {
+			fatalf(nil, "-corpora drive requires -drive-id")
+		}
+	default:
+		fatalf(nil, "-corpora must be user, drive, allDrives or domain")
+	}
+	if finalVerifyMode && dryRun {
+		fatalf(nil, "-final-verify can't be combined with -dry-run")
+	}
+	if dryRunByFolder && (!dryRun || dryRunSample > 0) {
+		fatalf(nil, "-dry-run-by-folder requires -dry-run, and can't be combined with -dry-run-sample")
+	}
+	if dryRunSample > 0 && !dryRun {
+		fatalf(nil, "-dry-run-sample requires -dry-run")
+	}
+	if reportFieldList != "" {
+		if jsonlPath == "" {
+			fatalf(nil, "-report-fields requires -jsonl")
+		}
+		var err error
+		reportFields, err = parseReportFields(reportFieldList)
+		if err != nil {
+			fatalf(nil, "Invalid -report-fields: %v", err)
+		}
+	}
+	if jsonlPath != "" {
+		var err error
+		events, err = openEventLog(jsonlPath, jsonlBatchSize, jsonlFlushEvery)
+		if err != nil {
+			fatalf(nil, "Unable to open -jsonl output: %v", err)
+		}
+	}
+	if metadataDumpPath != "" && !dryRun {
+		var err error
+		metadataDump, err = openMetadataLog(metadataDumpPath)
+		if err != nil {
+			fatalf(nil, "Unable to open -metadata-dump output: %v", err)
+		}
+	}
+	if concurrencyAuto {
+		activeWorkers = newWorkerLimit(1)
+		go adjustConcurrency(ctx, activeWorkers, workers)
+	} else if rampDuration > 0 && workers > 1 {
+		activeWorkers = newWorkerLimit(1)
+		go rampConcurrency(ctx, activeWorkers, workers, rampDuration)
+	}
+	startWorkers(workers)
+
+	if startJitter > 0 {
+		// seeded so that instances started together don't all pick the same
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano() + int64(os.Getpid())))
+		delay := time.Duration(rnd.Int63n(int64(startJitter)))
+		log.Printf("Waiting %v before starting", delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+
+	b, err := ioutil.ReadFile(clientSecretFile())
 	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
+		fatalf(nil, "Unable to read client secret file: %v", err)
 	}
 
 	// If modifying these scopes, delete your previously saved credentials
-	config, err := google.ConfigFromJSON(b, "https://www.googleapis.com/auth/drive")
+	scope := "https://www.googleapis.com/auth/drive"
+	if readOnly {
+		scope = "https://www.googleapis.com/auth/drive.readonly"
+	}
+	config, err := google.ConfigFromJSON(b, scope)
 	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
+		fatalf(nil, "Unable to parse client secret file to config: %v", err)
 	}
 	client := getClient(ctx, config)
+	if userAgent != "" {
+		client.Transport = &userAgentTransport{userAgent: userAgent, base: client.Transport}
+	}
+	if readOnly {
+		client.Transport = &readOnlyTransport{base: client.Transport}
+	}
 
 	srv, err := drive.New(client)
 	if err != nil {
-		log.Fatalf("Unable to retrieve drive Client %v", err)
+		fatalf(nil, "Unable to retrieve drive Client %v", err)
 	}
 
-	if args := flag.Args(); len(args) > 0 {
-		for _, folderId := range args {
-			err := processFolder(srv, folderId, "")
+	folders, err := checkAccess(srv, folderIDs)
+	if err != nil {
+		fatalCode(nil, exitCode(err), "Preflight check failed: %v", err)
+	}
+	if sharedDriveTrash != "" {
+		if err := checkSharedDrive(srv, driveID); err != nil {
+			fatalCode(nil, exitCode(err), "Preflight check failed: %v", err)
+		}
+	}
+	if restoredIDsDir != "" {
+		restoredIDs, err = openRestoredSet(restoredIDsDir, account)
+		if err != nil {
+			fatalf(nil, "Unable to open the restored files of -restored-ids-dir: %v", err)
+		}
+	}
+
+	if listExpiringMode {
+		err := listExpiring(ctx, srv, time.Duration(expiringDays)*24*time.Hour)
+		if err != nil {
+			fatalf(nil, "Unable to list trash: %v", err)
+		}
+		events.close()
+		exit(exitOK)
+	}
+
+	if benchmarkListMode {
+		concurrency := listWorkers
+		if concurrency <= 0 {
+			concurrency = workers
+		}
+		benchmarkList(ctx, srv, folders, concurrency)
+		exit(exitOK)
+	}
+
+	if streamMode {
+		err := streamTrash(ctx, srv)
+		if err != nil {
+			fatalf(nil, "Unable to stream trash: %v", err)
+		}
+		exit(exitOK)
+	}
+
+	if listDuplicatesMode {
+		err := listDuplicates(ctx, srv)
+		if err != nil {
+			fatalf(nil, "Unable to list trash: %v", err)
+		}
+		exit(exitOK)
+	}
+
+	if listOwnersMode {
+		err := listOwners(ctx, srv)
+		if err != nil {
+			fatalf(nil, "Unable to list trash: %v", err)
+		}
+		exit(exitOK)
+	}
+
+	if dumpFolderTree {
+		listed := map[string]bool{}
+		if len(folders) > 0 {
+			for _, folder := range folders {
+				err := dumpFolders(ctx, srv, folder.Id, folder.Title, 0, listed)
+				if err != nil {
+					logError("Unable to list folder %q: %v", folder.Id, err)
+				}
+			}
+		} else {
+			err := dumpFolders(ctx, srv, "root", "/", 0, listed)
 			if err != nil {
-				log.Printf("Unable to list folder %q: %v", folderId, err)
+				fatalf(nil, "Unable to list drive: %v", err)
 			}
 		}
-	} else {
-		err := processFolder(srv, "", "/")
+		exit(exitOK)
+	}
+
+	if serveAddr != "" {
+		fatalf(nil, "%v", serve(ctx, srv, serveAddr))
+	}
+
+	r := newRestorer(ctx, srv)
+	if recoveryFolder && !dryRun {
+		folder, err := createRecoveryFolder(ctx, srv)
 		if err != nil {
-			log.Fatalf("Unable to list drive: %v", err)
+			fatalf(r, "Unable to create the recovery folder: %v", err)
+		}
+		log.Printf("Moving restored files into folder %v %v", folder.Id, folder.Title)
+		r.recoveryFolder = folder.Id
+	}
+	if dedupRestore != "" {
+		q := "trashed = true"
+		if sharedWithMe {
+			q = "sharedWithMe = true and trashed = true"
+		}
+		var roots []string
+		if !flat {
+			for _, folder := range folders {
+				roots = append(roots, folder.Id)
+			}
+		}
+		if err := r.findNewest(q, roots); err != nil {
+			fatalf(r, "Unable to find the trashed duplicates: %v", err)
+		}
+		log.Printf("Found %d distinct trashed files, restoring only the newest of their duplicates", len(r.newest))
+	}
+	if trashedCount && reconcileAttempts == 0 {
+		n, err := r.countTrash()
+		if err != nil {
+			logError("Unable to count the trashed items: %v", err)
+		} else {
+			log.Printf("Approximately %d trashed items to process", n)
+		}
+	}
+	if resumeFrom != "" {
+		n, err := r.readCheckpoint(resumeFrom)
+		if err != nil {
+			fatalf(r, "Unable to read -resume checkpoint: %v", err)
+		}
+		log.Printf("Resuming, skipping the %d folders finished before", n)
+	}
+	logStatusOnSignal(r)
+	if memLimit > 0 {
+		go watchMemory(ctx, uint64(memLimit)*1000*1000)
+	}
+	if controlFile != "" {
+		go watchControlFile(ctx, controlFile)
+		if pauseOnQuota {
+			beforeQuotaPause = func() {
+				path := controlFile + ".checkpoint"
+				if err := r.writeCheckpoint(path); err != nil {
+					logError("Unable to write checkpoint: %v", err)
+				} else {
+					log.Printf("Wrote the folders finished so far to %s, run again with -resume %s if this run doesn't carry on", path, path)
+				}
+			}
+		}
+	}
+	stopProgress := func() {}
+	if progressEvery > 0 {
+		stopProgress = showProgress(r, progressEvery)
+	}
+	steady := true
+	if planIn != "" {
+		files, err := readPlan(planIn)
+		if err != nil {
+			fatalf(r, "Unable to read plan: %v", err)
+		}
+		r.applyPlan(files)
+	} else if reconcileAttempts > 0 {
+		steady, err = r.reconcile(reconcileAttempts)
+		if err != nil {
+			r.addUnlisted("trash", "trash", err)
+		}
+	} else if flat {
+		err := r.processTrash("trashed = true")
+		if err != nil {
+			r.addUnlisted("trash", "trash", err)
+		}
+	} else if sharedWithMe {
+		// these have no parent in the drive, walking the folders misses them
+		err := r.processTrash("sharedWithMe = true and trashed = true")
+		if err != nil {
+			r.addUnlisted("shared-with-me", "shared with me", err)
+		}
+	} else if bfs {
+		if len(folders) == 0 {
+			folders = []*drive.File{{Id: "", Title: "/"}}
+		}
+		for _, folder := range folders {
+			r.rememberTrashed(folder.Id, isTrashed(folder))
+		}
+		r.processLevels(folders)
+	} else if len(folders) > 0 {
+		for _, folder := range folders {
+			r.rememberTrashed(folder.Id, isTrashed(folder))
+			err := r.processFolder(folder.Id, folder.Title)
+			if err != nil && err != errBudgetExhausted {
+				r.addUnlisted(folder.Id, folder.Title, err)
+			}
+		}
+	} else {
+		// the top folder of a shared drive has the ID of the drive
+		err := r.processFolder(driveID, "/")
+		if err != nil && err != errBudgetExhausted {
+			r.addUnlisted(driveID, "/", err)
 		}
 	}
 
 	log.Printf("Waiting for goroutines to finish...")
-	wg.Wait()
-	log.Printf("Processed %d folders in total", countFolders)
-	log.Printf("Restored %d files in total", countRestored)
+	r.wait()
+	r.finishing.Wait()
+	if restoresHeld() {
+		r.restoreInOrder()
+		r.wait()
+		if !stopRequested() && !budgetExhausted() && r.ctx.Err() == nil {
+			r.finishHeld()
+		}
+	}
+	hooks.wait()
+	if controlFile != "" && (stopRequested() || budgetExhausted()) {
+		path := controlFile + ".checkpoint"
+		reason := "Stopped by -control-file"
+		if !stopRequested() {
+			reason = "Out of API calls"
+		}
+		if err := r.writeCheckpoint(path); err != nil {
+			logError("Unable to write checkpoint: %v", err)
+		} else {
+			log.Printf("%s, wrote the folders finished so far to %s, run again with -resume %s to carry on", reason, path, path)
+		}
+	}
+	stopProgress()
+	abortErr := r.abortError()
+	var stillTrashed []string
+	if finalVerifyMode && abortErr == nil {
+		left, err := r.finalVerify()
+		if err != nil {
+			logError("Unable to verify the trash: %v", err)
+		}
+		for _, f := range left {
+			stillTrashed = append(stillTrashed, f.Id)
+		}
+	}
+	r.logSummary()
+	if planOut != "" {
+		if err := r.writePlan(planOut); err != nil {
+			fatalf(r, "Unable to write plan: %v", err)
+		}
+	}
+	if dryRun {
+		checkQuota(ctx, srv, int64(r.countBytes))
+	}
+	events.close()
+	metadataDump.close()
+	restoredIDs.close()
+	s := r.summary()
+	s.StillTrashed = stillTrashed
+	if abortErr != nil {
+		s.Error = abortErr.Error()
+	}
+	notifyWebhook(s)
+	if sheetOutput != "" && abortErr == nil {
+		r.exportSheet(client, s)
+	}
+	code := exitOK
+	if abortErr != nil {
+		logError("Stopped restoring: %v", abortErr)
+		code = exitCode(abortErr)
+	} else if budgetExhausted() {
+		log.Printf("API call budget of %d calls exhausted, run again later to restore the rest", maxAPICalls)
+		code = exitQuota
+	} else if s.Failures["quota"] > 0 {
+		code = exitQuota
+	} else if s.FoldersIncomplete > 0 {
+		code = exitTimedOut
+	} else if !steady {
+		log.Printf("Trash still has files to restore after %d attempts", reconcileAttempts)
+		code = exitPartial
+	} else if s.Failed > 0 || len(r.unlisted) > 0 || len(stillTrashed) > 0 || stopRequested() {
+		code = exitPartial
+	}
+	exit(code)
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/rclone/rclone/lib/pacer"
+	"google.golang.org/api/googleapi"
+)
+
+func apiError(code int, reason string) *googleapi.Error {
+	gerr := &googleapi.Error{Code: code}
+	if reason != "" {
+		gerr.Errors = []googleapi.ErrorItem{{Reason: reason}}
+	}
+	return gerr
+}
+
+func TestShouldRetry(t *testing.T) {
+	defer func(pause func(), enabled bool) {
+		pauseForQuota, pauseOnQuota = pause, enabled
+	}(pauseForQuota, pauseOnQuota)
+	var paused int
+	pauseForQuota = func() { paused++ }
+
+	retryAfter := apiError(http.StatusTooManyRequests, "")
+	retryAfter.Header = http.Header{"Retry-After": []string{"7"}}
+	tests := []struct {
+		name         string
+		err          error
+		pauseOnQuota bool
+		retry        bool
+		retryAfter   time.Duration
+		paused       bool
+	}{
+		{name: "500", err: apiError(500, ""), retry: true},
+		{name: "503", err: apiError(503, "backendError"), retry: true},
+		{name: "429", err: apiError(http.StatusTooManyRequests, ""), retry: true},
+		{name: "429 with Retry-After", err: retryAfter, retry: true, retryAfter: 7 * time.Second},
+		{name: "403 rateLimitExceeded", err: apiError(403, "rateLimitExceeded"), retry: true},
+		{name: "403 userRateLimitExceeded", err: apiError(403, "userRateLimitExceeded"), retry: true},
+		{name: "403 dailyLimitExceeded", err: apiError(403, "dailyLimitExceeded")},
+		{name: "403 dailyLimitExceeded with -pause-on-quota", err: apiError(403, "dailyLimitExceeded"), pauseOnQuota: true, retry: true, paused: true},
+		{name: "403 insufficientFilePermissions", err: apiError(403, "insufficientFilePermissions")},
+		{name: "404", err: apiError(404, "notFound")},
+		{name: "401", err: apiError(401, "authError")},
+		{name: "nil"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pauseOnQuota = tt.pauseOnQuota
+			paused = 0
+			retry, err := shouldRetry(tt.err)
+			if retry != tt.retry {
+				t.Errorf("retry = %v, want %v", retry, tt.retry)
+			}
+			d, ok := pacer.IsRetryAfter(err)
+			if tt.retryAfter > 0 {
+				if !ok || d != tt.retryAfter {
+					t.Errorf("retry after = %v, %v, want %v", d, ok, tt.retryAfter)
+				}
+			} else if ok || err != tt.err {
+				t.Errorf("err = %v, want %v unchanged", err, tt.err)
+			}
+			if (paused > 0) != tt.paused {
+				t.Errorf("paused %d times, want paused %v", paused, tt.paused)
+			}
+		})
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{apiError(http.StatusTooManyRequests, ""), "rate-limited"},
+		{apiError(403, "rateLimitExceeded"), "rate-limited"},
+		{apiError(403, "dailyLimitExceeded"), "quota"},
+		{apiError(403, "insufficientFilePermissions"), "permission"},
+		{apiError(404, "notFound"), "not-found"},
+		{apiError(503, ""), "server"},
+		{errors.New("x"), "other"},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.err); got != tt.want {
+			t.Errorf("classifyError(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+// timeoutError is a net.Error like the timeouts of net/http.
+type timeoutError string
+
+func (e timeoutError) Error() string   { return string(e) }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+func TestIsTransientNetError(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"ECONNRESET", reset, true},
+		{"EPIPE", &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}, true},
+		{"ECONNABORTED", syscall.ECONNABORTED, true},
+		{"unexpected EOF", io.ErrUnexpectedEOF, true},
+		{"net.Error timeout", timeoutError("i/o timeout"), true},
+		// the TLS handshake timeout of net/http is a net.Error, so it
+		// needs no matching on the message
+		{"TLS handshake timeout", &url.Error{Op: "Post", URL: "https://www.googleapis.com/", Err: timeoutError("net/http: TLS handshake timeout")}, true},
+		{"TLS record header", tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, true},
+		{"TLS handshake failure", errors.New("remote error: tls: handshake failure"), false},
+		{"DNS timeout", &net.DNSError{Err: "timeout", Name: "www.googleapis.com", IsTimeout: true}, true},
+		{"DNS not found", &net.DNSError{Err: "no such host", Name: "www.googleapis.com", IsNotFound: true}, false},
+		{"wrapped in url.Error", &url.Error{Op: "Get", URL: "https://www.googleapis.com/", Err: reset}, true},
+		{"wrapped with %w", fmt.Errorf("listing: %w", io.ErrUnexpectedEOF), true},
+		{"context canceled", context.Canceled, false},
+		{"context deadline", context.DeadlineExceeded, false},
+		// a url.Error for a deadline is a timeout as well, but retrying it
+		// would outlive the context
+		{"wrapped context deadline", &url.Error{Op: "Get", URL: "https://www.googleapis.com/", Err: context.DeadlineExceeded}, false},
+		{"other", errors.New("x509: certificate signed by unknown authority"), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransientNetError(tt.err); got != tt.want {
+				t.Errorf("isTransientNetError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCachedToken(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("missing", func(t *testing.T) {
+		tok, err := cachedToken(filepath.Join(dir, "missing.json"))
+		if tok != nil || err != nil {
+			t.Errorf("got %v, %v, want no token and no error", tok, err)
+		}
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		file := filepath.Join(dir, "valid.json")
+		if err := ioutil.WriteFile(file, []byte(`{"refresh_token":"r"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		tok, err := cachedToken(file)
+		if err != nil || tok == nil || tok.RefreshToken != "r" {
+			t.Errorf("got %v, %v, want the refresh token", tok, err)
+		}
+	})
+
+	for name, content := range map[string]string{"truncated": `{"access_tok`, "empty token": `{}`} {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(dir, name+".json")
+			if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			tok, err := cachedToken(file)
+			if tok != nil || err != nil {
+				t.Errorf("got %v, %v, want no token and no error", tok, err)
+			}
+			if _, err := os.Stat(file); !os.IsNotExist(err) {
+				t.Errorf("corrupt file is still there: %v", err)
+			}
+			b, err := ioutil.ReadFile(file + ".corrupt")
+			if err != nil || string(b) != content {
+				t.Errorf("backup holds %q, %v, want %q", b, err, content)
+			}
+		})
+	}
+
+	t.Run("unreadable", func(t *testing.T) {
+		// reading a directory fails like a file without permission
+		file := filepath.Join(dir, "unreadable.json")
+		if err := os.Mkdir(file, 0700); err != nil {
+			t.Fatal(err)
+		}
+		tok, err := cachedToken(file)
+		if tok != nil || err == nil {
+			t.Errorf("got %v, %v, want an error", tok, err)
+		}
+		if _, err := os.Stat(file + ".corrupt"); !os.IsNotExist(err) {
+			t.Errorf("unreadable file was backed up: %v", err)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// how often the heap is checked against -mem-limit
+const memoryCheckEvery = time.Second
+
+// overMemoryLimit is 1 while the heap is above -mem-limit.
+var overMemoryLimit int32
+
+// watchMemory checks the heap against limit bytes until ctx is done, so
+// that waitForMemory holds up the listings while it's above it.
+func watchMemory(ctx context.Context, limit uint64) {
+	ticker := time.NewTicker(memoryCheckEvery)
+	defer ticker.Stop()
+	var m runtime.MemStats
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		runtime.ReadMemStats(&m)
+		if m.HeapAlloc > limit {
+			// what's above the limit may be garbage only, and with the
+			// listings stopped there may be nothing left to trigger a GC
+			runtime.GC()
+			runtime.ReadMemStats(&m)
+		}
+		over := m.HeapAlloc > limit
+		if over && atomic.CompareAndSwapInt32(&overMemoryLimit, 0, 1) {
+			logWarning("Heap is at %s, above -mem-limit, not listing new pages until the restores in flight use less", formatBytes(int64(m.HeapAlloc)))
+		} else if !over && atomic.CompareAndSwapInt32(&overMemoryLimit, 1, 0) {
+			log.Printf("Heap is down to %s, listing again", formatBytes(int64(m.HeapAlloc)))
+		}
+	}
+}
+
+// waitForMemory waits while the heap is above -mem-limit, or until ctx is
+// done.
+func waitForMemory(ctx context.Context) {
+	for atomic.LoadInt32(&overMemoryLimit) == 1 {
+		select {
+		case <-time.After(memoryCheckEvery):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
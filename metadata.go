@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// metadataLog writes the full metadata of the restored files as JSON lines
+// for -metadata-dump.
+type metadataLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+// metadataDump is nil unless -metadata-dump is given.
+var metadataDump *metadataLog
+
+func openMetadataLog(path string) (*metadataLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	return &metadataLog{f: f, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func (l *metadataLog) write(f *drive.File) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(f); err != nil {
+		logError("Unable to write the metadata of %v %v: %v", f.Id, f.Title, err)
+	}
+}
+
+// close flushes the output, it's a no-op on a nil metadataLog.
+func (l *metadataLog) close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.w.Flush(); err != nil {
+		logError("Unable to write -metadata-dump output: %v", err)
+	}
+	l.f.Close()
+}
+
+// dumpMetadata gets all the metadata of a restored file and writes it to
+// the -metadata-dump output.
+func (r *restorer) dumpMetadata(f *drive.File) {
+	var full *drive.File
+	err := p.Call(func() (bool, error) {
+		if !spendCall() {
+			return false, errBudgetExhausted
+		}
+		defer apiCalls.time("get")()
+		var err error
+		full, err = r.srv.Files.Get(f.Id).SupportsAllDrives(true).Context(r.ctx).Do()
+		return shouldRetry(err)
+	})
+	if err != nil {
+		logError("Unable to get the metadata of restored %v %v: %s%s", f.Id, f.Title, err, requestInfo(err))
+		return
+	}
+	metadataDump.write(full)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// pendingRestore is a restore held back until the end of the walk by
+// -restore-order or -size-budget.
+type pendingRestore struct {
+	f        *drive.File
+	folderID string
+	trashed  time.Time
+}
+
+// restoresHeld reports whether the restores wait for the end of the walk,
+// for -restore-order or -size-budget.
+func restoresHeld() bool {
+	return restoreOrder != "none" || sizeBudget > 0
+}
+
+// holdRestore keeps the restore of f for restoreInOrder, unless it's
+// held already.
+func (r *restorer) holdRestore(f *drive.File, folderID string) {
+	pr := pendingRestore{f: f, folderID: folderID}
+	if f.TrashedDate != "" {
+		t, err := time.Parse(time.RFC3339, f.TrashedDate)
+		if err != nil {
+			logError("Unable to parse trashed time %q of %v %v: %v", f.TrashedDate, f.Id, f.Title, err)
+		}
+		pr.trashed = t
+	}
+	r.heldMutex.Lock()
+	defer r.heldMutex.Unlock()
+	if r.heldIDs[f.Id] {
+		return
+	}
+	r.heldIDs[f.Id] = true
+	r.held = append(r.held, pr)
+}
+
+// restoreInOrder restores the held files one at a time, by when they were
+// trashed: the oldest first for fifo, the newest first for lifo. Files
+// without a trashed time go last, in the order they were found.
+//
+// With -size-budget they go by size instead, see restoreInBudget.
+func (r *restorer) restoreInOrder() {
+	r.heldMutex.Lock()
+	held := r.held
+	r.held = nil
+	r.heldMutex.Unlock()
+	if sizeBudget > 0 {
+		r.restoreInBudget(held)
+		return
+	}
+	sort.SliceStable(held, func(i, j int) bool {
+		a, b := held[i].trashed, held[j].trashed
+		if a.IsZero() || b.IsZero() {
+			return !a.IsZero() && b.IsZero()
+		}
+		if restoreOrder == "lifo" {
+			return a.After(b)
+		}
+		return a.Before(b)
+	})
+	log.Printf("Restoring %d files in %s order", len(held), restoreOrder)
+	for _, pr := range held {
+		waitWhilePaused(r.ctx)
+		if r.ctx.Err() != nil || stopRequested() {
+			return
+		}
+		r.restoreFile(pr.f, pr.folderID)
+	}
+}
+
+// restoreInBudget hands the held files over to the worker pool, the
+// smallest or largest first by -size-budget-order, as long as they fit in
+// the rest of the -size-budget. A file counts against the budget once it's
+// handed over, whether its restore succeeds or not.
+func (r *restorer) restoreInBudget(held []pendingRestore) {
+	sort.SliceStable(held, func(i, j int) bool {
+		if sizeBudgetOrder == "largest" {
+			return held[i].f.FileSize > held[j].f.FileSize
+		}
+		return held[i].f.FileSize < held[j].f.FileSize
+	})
+	budget := uint64(sizeBudget) * 1000 * 1000
+	log.Printf("Restoring up to %s of %d files, the %s first", formatBytes(int64(budget)), len(held), sizeBudgetOrder)
+	var reserved uint64
+	for i, pr := range held {
+		waitWhilePaused(r.ctx)
+		if r.ctx.Err() != nil || stopRequested() {
+			return
+		}
+		size := uint64(pr.f.FileSize)
+		if reserved+size > budget {
+			if sizeBudgetOrder == "smallest" {
+				// none of the rest fits either
+				for _, pr := range held[i:] {
+					r.leaveOverBudget(pr)
+				}
+				return
+			}
+			// a smaller one further down may still fit
+			r.leaveOverBudget(pr)
+			continue
+		}
+		reserved += size
+		pr := pr
+		r.wg.Add(1)
+		job := func() {
+			r.restoreFile(pr.f, pr.folderID)
+			r.wg.Done()
+		}
+		select {
+		case restoreQueue <- job:
+		case <-r.ctx.Done():
+			r.wg.Done()
+			return
+		}
+	}
+}
+
+// leaveOverBudget counts a held file left out of the -size-budget, which
+// -final-verify doesn't expect restored then.
+func (r *restorer) leaveOverBudget(pr pendingRestore) {
+	atomic.AddUint64(&r.countOverSizeBudget, 1)
+	if finalVerifyMode {
+		r.report("left_alone", pr.f, pr.folderID, nil)
+	}
+}
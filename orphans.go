@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// hasLiveParent reports whether f has a parent that exists and isn't
+// trashed, so that restoring it doesn't leave it orphaned. Parents that
+// can't be looked up for other reasons count as live.
+func (r *restorer) hasLiveParent(f *drive.File) bool {
+	for _, parent := range f.Parents {
+		r.trashedFoldersMutex.Lock()
+		trashed, ok := r.trashedFolders[parent.Id]
+		gone := r.goneFolders[parent.Id]
+		r.trashedFoldersMutex.Unlock()
+		if gone {
+			continue
+		}
+		if !ok {
+			var pf *drive.File
+			err := p.Call(func() (bool, error) {
+				if !spendCall() {
+					return false, errBudgetExhausted
+				}
+				defer apiCalls.time("get")()
+				var err error
+				pf, err = r.srv.Files.Get(parent.Id).SupportsAllDrives(true).Fields("explicitlyTrashed, labels(trashed)").Context(r.ctx).Do()
+				return shouldRetry(err)
+			})
+			if gerr, isGoogle := googleError(err); isGoogle && gerr.Code == http.StatusNotFound {
+				r.trashedFoldersMutex.Lock()
+				r.goneFolders[parent.Id] = true
+				r.trashedFoldersMutex.Unlock()
+				continue
+			} else if err != nil {
+				logError("Unable to get parent %v of %v %v, assuming it exists: %s%s", parent.Id, f.Id, f.Title, err, requestInfo(err))
+				return true
+			}
+			trashed = isTrashed(pf)
+			r.rememberTrashed(parent.Id, trashed)
+		}
+		if !trashed {
+			return true
+		}
+	}
+	return false
+}
+
+// logOrphans logs the files skipped by -skip-orphans, to deal with them
+// by hand.
+func (r *restorer) logOrphans() {
+	r.resultsMutex.Lock()
+	defer r.resultsMutex.Unlock()
+	if len(r.orphans) == 0 {
+		return
+	}
+	log.Printf("Skipped %d files without a parent outside the trash:", len(r.orphans))
+	for _, f := range r.orphans {
+		log.Printf("  %s %s", f.Id, f.Title)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// plan is the list of files that a dry run would restore, written by
+// -plan-out to be approved and applied by -plan-in.
+type plan struct {
+	Created time.Time  `json:"created"`
+	Files   []planFile `json:"files"`
+	// SHA256 is the hash of the files. Anyone can compute it again, so it
+	// only notices plans edited by mistake, outdated plans are noticed by
+	// comparing the files with Drive while applying them.
+	SHA256 string `json:"sha256"`
+}
+
+// planFile is a file in a plan, with the state it was approved in.
+type planFile struct {
+	ID           string `json:"id"`
+	TrashedDate  string `json:"trashed_date,omitempty"`
+	ModifiedDate string `json:"modified_date,omitempty"`
+}
+
+func newPlanFile(f *drive.File) planFile {
+	return planFile{ID: f.Id, TrashedDate: f.TrashedDate, ModifiedDate: f.ModifiedDate}
+}
+
+func planHash(files []planFile) string {
+	lines := make([]string, len(files))
+	for i, pf := range files {
+		lines[i] = pf.ID + " " + pf.TrashedDate + " " + pf.ModifiedDate
+	}
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// writePlan writes the files this dry run would restore to path, in the
+// order the walk found them.
+func (r *restorer) writePlan(path string) error {
+	r.resultsMutex.Lock()
+	files := make([]planFile, 0, len(r.plan))
+	for _, pf := range r.plan {
+		files = append(files, pf)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		oi, oj := r.planOrder[files[i].ID], r.planOrder[files[j].ID]
+		return oi < oj || (oi == oj && files[i].ID < files[j].ID)
+	})
+	r.resultsMutex.Unlock()
+	pl := plan{Created: time.Now().UTC(), Files: files, SHA256: planHash(files)}
+	b, err := json.MarshalIndent(pl, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	log.Printf("Wrote a plan to restore %d files to %s", len(pl.Files), path)
+	return nil
+}
+
+// readPlan returns the files in the plan at path, warning if it doesn't
+// match its hash.
+func readPlan(path string) ([]planFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pl plan
+	if err := json.Unmarshal(b, &pl); err != nil {
+		return nil, err
+	}
+	if planHash(pl.Files) != pl.SHA256 {
+		logWarning("Plan %s doesn't match its hash, it was changed after it was made", path)
+	}
+	log.Printf("Applying a plan to restore %d files, made at %v", len(pl.Files), pl.Created.Local())
+	return pl.Files, nil
+}
+
+// errPlanOutdated fails the restore of a file that changed since the plan
+// was made, which the approval didn't cover.
+var errPlanOutdated = errors.New("file changed since the plan was made")
+
+// applyPlan restores the files of a plan one at a time, in its order, and
+// without applying the filters again, as they were when the plan was made.
+// Files that aren't in the trash anymore, or were trashed or modified
+// again since, are left in the trash and count as failed. A file listed
+// twice is only restored once.
+func (r *restorer) applyPlan(files []planFile) {
+	applied := map[string]bool{}
+	for _, pf := range files {
+		if applied[pf.ID] {
+			continue
+		}
+		applied[pf.ID] = true
+		waitWhilePaused(r.ctx)
+		if r.ctx.Err() != nil || stopRequested() {
+			return
+		}
+		if budgetExhausted() {
+			atomic.AddUint64(&r.countNotAttempted, 1)
+			continue
+		}
+		var f *drive.File
+		err := p.Call(func() (bool, error) {
+			if !spendCall() {
+				return false, errBudgetExhausted
+			}
+			defer apiCalls.time("get")()
+			var err error
+			f, err = r.srv.Files.Get(pf.ID).SupportsAllDrives(true).Fields(fileFields).Context(r.ctx).Do()
+			return shouldRetry(err)
+		})
+		if err == errBudgetExhausted {
+			atomic.AddUint64(&r.countNotAttempted, 1)
+			continue
+		} else if err != nil {
+			logError("Unable to get file %v: %s%s", pf.ID, err, requestInfo(err))
+			r.countFailure(&drive.File{Id: pf.ID}, "", err)
+			continue
+		}
+		if now := newPlanFile(f); !f.ExplicitlyTrashed || now != pf {
+			err := fmt.Errorf("%w: trashed %v at %q and modified at %q, planned trashed at %q and modified at %q", errPlanOutdated, f.ExplicitlyTrashed, now.TrashedDate, now.ModifiedDate, pf.TrashedDate, pf.ModifiedDate)
+			log.Printf("Not restoring %v %v: %v", f.Id, f.Title, err)
+			r.countFailure(f, "", err)
+			continue
+		}
+		if finalVerifyMode {
+			r.report("intended", f, "", nil)
+		}
+		atomic.AddUint64(&r.countTrashedFound, 1)
+		r.restoreFile(f, "root")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// isTerminal reports whether f is an interactive terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// showProgress shows the totals of r every interval until the returned
+// function is called. On a terminal it's a single line updated in place,
+// otherwise a log line each time.
+func showProgress(r *restorer, interval time.Duration) (stop func()) {
+	inPlace := isTerminal(os.Stderr)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if inPlace {
+					// \033[K clears what's left of a longer earlier line
+					fmt.Fprintf(os.Stderr, "\r%s\033[K", r.summary().status())
+				} else {
+					log.Printf("Progress: %s", r.summary().status())
+				}
+			case <-done:
+				if inPlace {
+					fmt.Fprintln(os.Stderr)
+				}
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
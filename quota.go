@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// quotaHeartbeat is how often a -pause-on-quota pause is logged.
+const quotaHeartbeat = 10 * time.Minute
+
+var (
+	quotaResumeAt    time.Time
+	quotaResumeMutex sync.Mutex
+)
+
+// beforeQuotaPause runs as a pause for the daily quota starts, main sets
+// it to write the checkpoint with -control-file.
+var beforeQuotaPause = func() {}
+
+// pauseForQuota is waitForQuotaReset, swapped out by the tests.
+var pauseForQuota = waitForQuotaReset
+
+// nextQuotaReset returns when the daily quota resets after now, which is
+// midnight Pacific time, with a few minutes to spare.
+func nextQuotaReset(now time.Time) time.Time {
+	pacific, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		// no time zone database, ignore daylight saving time
+		pacific = time.FixedZone("PST", -8*60*60)
+	}
+	t := now.In(pacific)
+	midnight := time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, pacific)
+	return midnight.Add(5 * time.Minute)
+}
+
+// waitForQuotaReset sleeps until the daily quota resets. The calls hitting
+// the quota while paused wait for the same reset, and only the first one
+// logs about it.
+func waitForQuotaReset() {
+	quotaResumeMutex.Lock()
+	resumeAt := quotaResumeAt
+	first := time.Until(resumeAt) <= 0
+	if first {
+		resumeAt = nextQuotaReset(time.Now())
+		quotaResumeAt = resumeAt
+	}
+	quotaResumeMutex.Unlock()
+	if !first {
+		time.Sleep(time.Until(resumeAt))
+		return
+	}
+	logWarning("Daily quota exceeded, pausing until %v", resumeAt.Local())
+	beforeQuotaPause()
+	for {
+		left := time.Until(resumeAt)
+		if left <= 0 {
+			break
+		}
+		if left > quotaHeartbeat {
+			time.Sleep(quotaHeartbeat)
+			log.Printf("Paused for the daily quota, resuming in %v", time.Until(resumeAt).Round(time.Minute))
+			continue
+		}
+		time.Sleep(left)
+	}
+	log.Printf("Resuming after the daily quota reset")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"golang.org/x/net/context"
+)
+
+// createRecoveryFolder creates the folder that this run moves the restored
+// files into, like "Restored-2024-06-01T12:00".
+func createRecoveryFolder(ctx context.Context, srv *drive.Service) (*drive.File, error) {
+	folder := &drive.File{
+		Title:    "Restored-" + time.Now().Format("2006-01-02T15:04"),
+		MimeType: "application/vnd.google-apps.folder",
+	}
+	var created *drive.File
+	err := p.Call(func() (bool, error) {
+		if !spendCall() {
+			return false, errBudgetExhausted
+		}
+		defer apiCalls.time("insert")()
+		var err error
+		created, err = srv.Files.Insert(folder).Fields("id, title").Context(ctx).Do()
+		return shouldRetry(err)
+	})
+	return created, err
+}
+
+// moveToRecovery moves a restored file into the recovery folder. Files
+// whose folder is trashed are left alone, they come back with it.
+func (r *restorer) moveToRecovery(f *drive.File, folderID string) {
+	r.trashedFoldersMutex.Lock()
+	parentTrashed := r.trashedFolders[folderID]
+	r.trashedFoldersMutex.Unlock()
+	if parentTrashed {
+		return
+	}
+	var parents []string
+	for _, parent := range f.Parents {
+		parents = append(parents, parent.Id)
+	}
+	err := p.Call(func() (bool, error) {
+		if !spendCall() {
+			return false, errBudgetExhausted
+		}
+		defer apiCalls.time("move")()
+		call := r.srv.Files.Patch(f.Id, &drive.File{}).SupportsAllDrives(true).AddParents(r.recoveryFolder).Fields("id")
+		if len(parents) > 0 {
+			call.RemoveParents(strings.Join(parents, ","))
+		}
+		_, err := call.Context(r.ctx).Do()
+		return shouldRetry(err)
+	})
+	if err != nil {
+		logError("Unable to move restored %v %v into the recovery folder: %s%s", f.Id, f.Title, err, requestInfo(err))
+		return
+	}
+	if verbose {
+		log.Printf("Moved %v %v from folder %v into the recovery folder", f.Id, f.Title, folderID)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// restoredSet is the set of files restored by earlier runs as the same
+// user, kept as one ID per line for -restored-ids-dir.
+type restoredSet struct {
+	mu  sync.Mutex
+	ids map[string]bool
+	f   *os.File
+}
+
+// restoredIDs is nil unless -restored-ids-dir is given.
+var restoredIDs *restoredSet
+
+// openRestoredSet loads the files restored as account from the set kept
+// in dir, and opens it to add the ones restored by this run.
+func openRestoredSet(dir, account string) (*restoredSet, error) {
+	path := filepath.Join(dir, "restored-"+url.QueryEscape(account)+".txt")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &restoredSet{ids: map[string]bool{}, f: f}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if id := scanner.Text(); id != "" {
+			s.ids[id] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	log.Printf("Not restoring the %d files restored by earlier runs, kept in %s", len(s.ids), path)
+	return s, nil
+}
+
+// has reports whether id was restored already, it's false on a nil
+// restoredSet.
+func (s *restoredSet) has(id string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ids[id]
+}
+
+// add records that id was restored, right away so that a crash doesn't
+// lose it. It's a no-op on a nil restoredSet.
+func (s *restoredSet) add(id string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ids[id] {
+		return
+	}
+	s.ids[id] = true
+	if _, err := s.f.WriteString(id + "\n"); err != nil {
+		logError("Unable to record %v as restored: %v", id, err)
+	}
+}
+
+// close closes the set, it's a no-op on a nil restoredSet.
+func (s *restoredSet) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.f.Close()
+}
@@ -0,0 +1,1288 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"golang.org/x/net/context"
+)
+
+// restorer holds the state of a single run, so that independent runs
+// don't share their counters and seen folders.
+type restorer struct {
+	// counters are updated atomically, keep them first for alignment
+	countRestored          uint64
+	countRestoredFolders   uint64
+	countRestoredFiles     uint64
+	countFolders           uint64
+	countTrashedFound      uint64
+	countSkippedMime       uint64
+	countSkippedInTrash    uint64
+	countSkippedParent     uint64
+	countSkippedRecent     uint64
+	countFailed            uint64
+	countMetadataChanged   uint64
+	countNotAttempted      uint64
+	countFoldersPruned     uint64
+	countFoldersIncomplete uint64
+	countRevisionsLost     uint64
+	countBytes             uint64
+	countParentsRestored   uint64
+	countSkippedDuplicate  uint64
+	countSkippedCreated    uint64
+	countSkippedExt        uint64
+	countSkippedOrphan     uint64
+	countChecksumMismatch  uint64
+	countSkippedTrashedBy  uint64
+	countSkippedRestored   uint64
+	countSkippedSample     uint64
+	countSkippedDedup      uint64
+	countOverSizeBudget    uint64
+
+	ctx context.Context
+	srv *drive.Service
+	wg  sync.WaitGroup
+
+	// cancels ctx, see abort
+	cancel     context.CancelFunc
+	abortErr   error
+	abortMutex sync.Mutex
+
+	// bounds the goroutines listing folders with -list-workers, nil if
+	// unbounded
+	listSlots chan struct{}
+
+	// the folder restored files are moved into, set before the run starts
+	recoveryFolder string
+
+	seen      map[string]int
+	seenMutex sync.Mutex
+	// folders listed in full along with the folders below them, for the
+	// checkpoint, guarded by seenMutex
+	finished map[string]bool
+	// folders that finished while their restores are held, they're only
+	// finished once restoreInOrder ran them all
+	finishedHeld []string
+	// the goroutines finishing the folders
+	finishing sync.WaitGroup
+
+	// files a dry run would restore, to count each of them once, as the
+	// whole-drive walk lists the files in folders twice
+	wouldRestore      map[string]bool
+	wouldRestoreMutex sync.Mutex
+
+	trashedFolders      map[string]bool
+	trashedFoldersMutex sync.Mutex
+	// folders that don't exist anymore, for -skip-orphans
+	goneFolders map[string]bool
+
+	// trashed ancestors restored with -restore-parents
+	ancestors      map[string]*ancestorRestore
+	ancestorsMutex sync.Mutex
+
+	// the collector adds up the results sent here, into the aggregates
+	// below guarded by resultsMutex
+	results      chan result
+	resultsMutex sync.Mutex
+	failures     map[string]uint64
+	sample       []string
+	sampleSeen   int64
+	sampleRand   *rand.Rand
+	// files a dry run would restore by folder, for -dry-run-by-folder
+	groups map[string][]*drive.File
+	// files this run tried to restore, for -final-verify
+	intended map[string]bool
+	// files a dry run would restore by ID, for -plan-out, and the order the
+	// walk found them in. The walk can come across a file more than once.
+	plan      map[string]planFile
+	planOrder map[string]int
+	// files skipped by -skip-orphans
+	orphans []*drive.File
+
+	unlisted      []unlistedFolder
+	unlistedMutex sync.Mutex
+
+	// titles and parents of the folders seen, to show their paths
+	folderNames      map[string]folderName
+	folderNamesMutex sync.Mutex
+
+	// the ID of the newest of each group of trashed duplicates, for
+	// -dedup-restore, set before the run starts
+	newest map[string]string
+
+	// the files handled, for -sheet-files
+	sheetRows []fileRow
+
+	// restores held back until the end of the walk by -restore-order or
+	// -size-budget, and the IDs of their files, which the walk can come
+	// across more than once
+	held      []pendingRestore
+	heldIDs   map[string]bool
+	heldMutex sync.Mutex
+
+	// folders to process at the next depth in -bfs mode
+	nextLevel      []levelFolder
+	nextLevelMutex sync.Mutex
+}
+
+// newRestorer returns a restorer using srv. Cancelling ctx stops the
+// traversal and aborts the API calls in flight.
+func newRestorer(ctx context.Context, srv *drive.Service) *restorer {
+	ctx, cancel := context.WithCancel(ctx)
+	var listSlots chan struct{}
+	if listWorkers > 0 {
+		listSlots = make(chan struct{}, listWorkers)
+	}
+	r := &restorer{
+		results:        make(chan result, resultsBuffer),
+		listSlots:      listSlots,
+		ctx:            ctx,
+		cancel:         cancel,
+		srv:            srv,
+		seen:           map[string]int{},
+		finished:       map[string]bool{},
+		wouldRestore:   map[string]bool{},
+		heldIDs:        map[string]bool{},
+		trashedFolders: map[string]bool{},
+		goneFolders:    map[string]bool{},
+		ancestors:      map[string]*ancestorRestore{},
+		folderNames:    map[string]folderName{},
+		groups:         map[string][]*drive.File{},
+		intended:       map[string]bool{},
+		plan:           map[string]planFile{},
+		planOrder:      map[string]int{},
+		failures:       map[string]uint64{},
+		sampleRand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	go r.collect()
+	return r
+}
+
+// abort stops the run on err, cancelling the API calls in flight. The
+// caller still waits for the workers as usual, and then ends the run
+// with abortError. Only the first error is kept.
+func (r *restorer) abort(err error) {
+	r.abortMutex.Lock()
+	defer r.abortMutex.Unlock()
+	if r.abortErr == nil {
+		r.abortErr = err
+		r.cancel()
+	}
+}
+
+// abortError returns the error the run was aborted with, or nil.
+func (r *restorer) abortError() error {
+	r.abortMutex.Lock()
+	defer r.abortMutex.Unlock()
+	return r.abortErr
+}
+
+// folderRun is the work in progress on a single folder.
+type folderRun struct {
+	id    string
+	title string
+	// ctx is cancelled once the folder ran for too long
+	ctx      context.Context
+	cancel   context.CancelFunc
+	watchdog *watchdog
+	// restores of a single folder share these, so that huge folders
+	// can't take up the whole worker pool
+	slots chan struct{}
+	// pages counts the pages being handled, and restores the restores
+	// handed over to the worker pool
+	pages      sync.WaitGroup
+	restores   sync.WaitGroup
+	incomplete int32
+	// set once the API call budget left one of its restores out
+	refused int32
+	// the folder this one was found in, nil at the top of the walk
+	parent *folderRun
+	// the folders walked from this one, and whether one of them or one
+	// below them wasn't finished
+	children   sync.WaitGroup
+	unfinished int32
+}
+
+func (r *restorer) newFolderRun(id, title string, slots int) *folderRun {
+	fr := &folderRun{id: id, title: title, slots: make(chan struct{}, slots)}
+	fr.ctx, fr.cancel = context.WithCancel(r.ctx)
+	if folderTimeout > 0 {
+		fr.watchdog = newWatchdog(folderTimeout, fr.cancel)
+	}
+	return fr
+}
+
+// waitWhilePaused is waitWhilePaused for the work on fr, with its watchdog
+// stopped meanwhile so that a long pause doesn't abandon the folder.
+func (fr *folderRun) waitWhilePaused() {
+	fr.watchdog.hold()
+	defer fr.watchdog.release()
+	waitWhilePaused(fr.ctx)
+}
+
+// childDone marks a folder walked from fr as done, finished or not. It's a
+// no-op on a nil folderRun.
+func (fr *folderRun) childDone(finished bool) {
+	if fr == nil {
+		return
+	}
+	if !finished {
+		atomic.StoreInt32(&fr.unfinished, 1)
+	}
+	fr.children.Done()
+}
+
+// finishFolder records fr as finished if it was listed in full, without
+// being abandoned or stopped, and so were all the folders below it.
+func (r *restorer) finishFolder(fr *folderRun, listed bool) {
+	finished := listed && atomic.LoadInt32(&fr.incomplete) == 0 && atomic.LoadInt32(&fr.refused) == 0 && atomic.LoadInt32(&fr.unfinished) == 0 && r.ctx.Err() == nil && !stopRequested()
+	if finished {
+		r.seenMutex.Lock()
+		if restoresHeld() {
+			r.finishedHeld = append(r.finishedHeld, fr.id)
+		} else {
+			r.finished[fr.id] = true
+		}
+		r.seenMutex.Unlock()
+	}
+	fr.parent.childDone(finished)
+}
+
+// abandoned reports whether the folder ran out of time, counting it as
+// incomplete the first time.
+func (r *restorer) abandoned(fr *folderRun) bool {
+	if fr.ctx.Err() == nil || r.ctx.Err() != nil {
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&fr.incomplete, 0, 1) {
+		logWarning("Folder ID \"%s\" with name \"%s\" took longer than %v, abandoning the rest of it", fr.id, fr.title, folderTimeout)
+		atomic.AddUint64(&r.countFoldersIncomplete, 1)
+	}
+	return true
+}
+
+func (r *restorer) restoreTrashed(folderID string, childs []*drive.File, recurse bool, fr *folderRun) {
+	// parent is only for logging purposes
+	if folderID == "" {
+		folderID = "root"
+	}
+	s := startSpan("restore page")
+	s.set("folder.id", folderID)
+	s.set("files", len(childs))
+	defer s.finish(nil)
+	for _, child := range childs {
+		if r.ctx.Err() != nil || r.abandoned(fr) || stopRequested() {
+			return
+		}
+		child = r.completeFile(child, folderID)
+		if child.ExplicitlyTrashed {
+			atomic.AddUint64(&r.countTrashedFound, 1)
+		}
+		if child.ExplicitlyTrashed && r.shouldRestore(child, folderID) {
+			r.enqueueRestore(child, folderID, fr)
+		}
+
+		if child.MimeType == "application/vnd.google-apps.folder" {
+			r.rememberTrashed(child.Id, isTrashed(child))
+			r.rememberFolderName(child.Id, child.Title, folderID)
+		}
+		// restoring a trashed folder brings back its contents, and in
+		// roots-only mode there's nothing to restore below it anyway
+		if recurse && child.MimeType == "application/vnd.google-apps.folder" && !((rootsOnly || trashedFolderNoRecurse) && isTrashed(child)) {
+			if modifiedBefore(child, folderCutoff.Time) {
+				if verbose {
+					log.Printf("Not processing folder ID \"%s\" with name \"%s\", last modified %s", child.Id, child.Title, child.ModifiedDate)
+				}
+				atomic.AddUint64(&r.countFoldersPruned, 1)
+				continue
+			}
+			fr.children.Add(1)
+			if bfs {
+				r.nextLevelMutex.Lock()
+				r.nextLevel = append(r.nextLevel, levelFolder{child, fr})
+				r.nextLevelMutex.Unlock()
+				continue
+			}
+			// the subfolder has its own watchdog, it's not this folder's
+			// time
+			fr.watchdog.hold()
+			err := r.walkFolder(fr, child.Id, child.Title)
+			fr.watchdog.release()
+			if err != nil && err != errBudgetExhausted {
+				r.addUnlisted(child.Id, child.Title, err)
+			}
+		}
+		if target := shortcutFolder(child); recurse && followShortcuts && target != nil {
+			if verbose {
+				log.Printf("Following shortcut %v %v to folder ID \"%s\"", child.Id, child.Title, target.Id)
+			}
+			// the seen map stops shortcut cycles
+			fr.children.Add(1)
+			if bfs {
+				r.nextLevelMutex.Lock()
+				r.nextLevel = append(r.nextLevel, levelFolder{target, fr})
+				r.nextLevelMutex.Unlock()
+				continue
+			}
+			fr.watchdog.hold()
+			err := r.walkFolder(fr, target.Id, target.Title)
+			fr.watchdog.release()
+			if err != nil && err != errBudgetExhausted {
+				r.addUnlisted(target.Id, target.Title, err)
+			}
+		}
+	}
+}
+
+// shortcutFolder returns the folder that f is a shortcut to, or nil if f
+// isn't a shortcut to a folder.
+func shortcutFolder(f *drive.File) *drive.File {
+	if f.MimeType != "application/vnd.google-apps.shortcut" || f.ShortcutDetails == nil {
+		return nil
+	}
+	if f.ShortcutDetails.TargetMimeType != "application/vnd.google-apps.folder" {
+		return nil
+	}
+	return &drive.File{Id: f.ShortcutDetails.TargetId, Title: f.Title, MimeType: f.ShortcutDetails.TargetMimeType}
+}
+
+// missingFields returns the fields that the current mode needs but are
+// missing from f.
+func missingFields(f *drive.File) []string {
+	var missing []string
+	if f.MimeType == "" {
+		missing = append(missing, "mimeType")
+	}
+	if !folderCutoff.IsZero() && f.ModifiedDate == "" {
+		missing = append(missing, "modifiedDate")
+	}
+	if minTrashedAge > 0 && f.ExplicitlyTrashed && f.TrashedDate == "" {
+		missing = append(missing, "trashedDate")
+	}
+	if restoreOrder != "none" && f.ExplicitlyTrashed && f.TrashedDate == "" {
+		missing = append(missing, "trashedDate")
+	}
+	if (!createdAfter.IsZero() || !createdBefore.IsZero()) && f.ExplicitlyTrashed && f.CreatedDate == "" {
+		missing = append(missing, "createdDate")
+	}
+	if (wasInParent != "" || rootsOnly) && len(f.Parents) == 0 {
+		missing = append(missing, "parents")
+	}
+	return missing
+}
+
+// completeFile returns f, or with -refetch-partial its full metadata if
+// the listing left out some of the fields the current mode needs.
+// Otherwise a file without a mime type would pass for a non-folder.
+func (r *restorer) completeFile(f *drive.File, folderID string) *drive.File {
+	missing := missingFields(f)
+	if len(missing) == 0 {
+		return f
+	}
+	if verbose {
+		logWarning("Listing of %v %v in folder %v is missing %s", f.Id, f.Title, folderID, strings.Join(missing, ", "))
+	}
+	if !refetchPartial {
+		return f
+	}
+	var full *drive.File
+	err := p.Call(func() (bool, error) {
+		if !spendCall() {
+			return false, errBudgetExhausted
+		}
+		defer apiCalls.time("get")()
+		var err error
+		full, err = r.srv.Files.Get(f.Id).SupportsAllDrives(true).Fields(fileFields).Context(r.ctx).Do()
+		return shouldRetry(err)
+	})
+	if err != nil {
+		logError("Unable to get the metadata of %v %v, using the listing: %s%s", f.Id, f.Title, err, requestInfo(err))
+		return f
+	}
+	return full
+}
+
+// modifiedBefore reports whether f was last modified before cutoff. Files
+// without a known modified time never are.
+func modifiedBefore(f *drive.File, cutoff time.Time) bool {
+	if cutoff.IsZero() || f.ModifiedDate == "" {
+		return false
+	}
+	modified, err := time.Parse(time.RFC3339, f.ModifiedDate)
+	if err != nil {
+		logError("Unable to parse modified time %q of %v %v: %v", f.ModifiedDate, f.Id, f.Title, err)
+		return false
+	}
+	return modified.Before(cutoff)
+}
+
+// trashedWithin reports whether f was trashed less than age ago. Files
+// without a known trashed time never are.
+func trashedWithin(f *drive.File, age time.Duration) bool {
+	if f.TrashedDate == "" {
+		return false
+	}
+	trashed, err := time.Parse(time.RFC3339, f.TrashedDate)
+	if err != nil {
+		logError("Unable to parse trashed time %q of %v %v: %v", f.TrashedDate, f.Id, f.Title, err)
+		return false
+	}
+	return time.Since(trashed) < age
+}
+
+// createdTime returns when f was created, if known.
+func createdTime(f *drive.File) (time.Time, bool) {
+	if f.CreatedDate == "" {
+		return time.Time{}, false
+	}
+	created, err := time.Parse(time.RFC3339, f.CreatedDate)
+	if err != nil {
+		logError("Unable to parse created time %q of %v %v: %v", f.CreatedDate, f.Id, f.Title, err)
+		return time.Time{}, false
+	}
+	return created, true
+}
+
+// skipReason applies the filters to a trashed file, returning why it's
+// skipped and the counter of files skipped for that, or "" if it isn't.
+func (r *restorer) skipReason(child *drive.File) (string, *uint64) {
+	if restoredIDs.has(child.Id) {
+		return "an earlier run restored it already", &r.countSkippedRestored
+	}
+	if matchMime(child.MimeType, excludeMime) {
+		return fmt.Sprintf("type %v is excluded", child.MimeType), &r.countSkippedMime
+	}
+	if ext := extension(child.Title); (len(includeExt) > 0 && !includeExt[ext]) || excludeExt[ext] {
+		return fmt.Sprintf("extension %q is excluded", ext), &r.countSkippedExt
+	}
+	if minTrashedAge > 0 && trashedWithin(child, minTrashedAge) {
+		return fmt.Sprintf("it was trashed only at %v", child.TrashedDate), &r.countSkippedRecent
+	}
+	if !createdAfter.IsZero() || !createdBefore.IsZero() {
+		if created, ok := createdTime(child); ok && (created.Before(createdAfter.Time) || (!createdBefore.IsZero() && !created.Before(createdBefore.Time))) {
+			return fmt.Sprintf("it was created at %v", child.CreatedDate), &r.countSkippedCreated
+		}
+	}
+	if trashedBy != "" && (child.TrashingUser == nil || !strings.EqualFold(child.TrashingUser.EmailAddress, trashedBy)) {
+		return fmt.Sprintf("it wasn't trashed by %v", trashedBy), &r.countSkippedTrashedBy
+	}
+	if samplePercent < 100 && !inSample(child.Id, samplePercent) {
+		return fmt.Sprintf("it's not in the %v%% sample", samplePercent), &r.countSkippedSample
+	}
+	if r.hasNewerDuplicate(child) {
+		return "a newer trashed duplicate is restored instead", &r.countSkippedDedup
+	}
+	if wasInParent != "" && !hasParent(child, wasInParent) {
+		return fmt.Sprintf("it wasn't in folder %v", wasInParent), &r.countSkippedParent
+	}
+	if rootsOnly && r.hasTrashedParent(child) {
+		return "it is inside a trashed folder", &r.countSkippedInTrash
+	}
+	if skipOrphans && !r.hasLiveParent(child) {
+		return "it has no parent outside the trash", &r.countSkippedOrphan
+	}
+	return "", nil
+}
+
+// inSample reports whether the file id is in a sample of percent of the
+// files. The sample only depends on the ID, so a larger percent takes in
+// the same files and more.
+func inSample(id string, percent float64) bool {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return float64(h.Sum32()%10000) < percent*100
+}
+
+// shouldRestore applies the filters to a trashed file, counting the
+// skipped ones.
+func (r *restorer) shouldRestore(child *drive.File, folderID string) bool {
+	reason, counter := r.skipReason(child)
+	if reason == "" {
+		return true
+	}
+	if verbose {
+		log.Printf("Skipping %v %v in folder %v, %s", child.Id, child.Title, folderID, reason)
+	}
+	atomic.AddUint64(counter, 1)
+	if counter == &r.countSkippedOrphan {
+		r.report("orphan", child, folderID, nil)
+	}
+	return false
+}
+
+// enqueueRestore hands the restore of child over to the worker pool.
+func (r *restorer) enqueueRestore(child *drive.File, folderID string, fr *folderRun) {
+	fr.waitWhilePaused()
+	if stopRequested() {
+		return
+	}
+	if budgetExhausted() {
+		atomic.AddUint64(&r.countNotAttempted, 1)
+		atomic.StoreInt32(&fr.refused, 1)
+		return
+	}
+	if finalVerifyMode || planOut != "" {
+		// also records the order of the walk, which the workers lose
+		r.report("intended", child, folderID, nil)
+	}
+	if restoresHeld() {
+		r.holdRestore(child, folderID)
+		return
+	}
+	// waiting for a free slot of this folder or a worker isn't running
+	fr.watchdog.hold()
+	defer fr.watchdog.release()
+	// wait for a free slot of this folder before taking up a worker
+	select {
+	case fr.slots <- struct{}{}:
+	case <-fr.ctx.Done():
+		r.abandoned(fr)
+		return
+	}
+	r.wg.Add(1)
+	fr.restores.Add(1)
+	job := func() {
+		r.restoreFile(child, folderID)
+		if budgetExhausted() {
+			// the restore may have been refused as well
+			atomic.StoreInt32(&fr.refused, 1)
+		}
+		<-fr.slots
+		fr.restores.Done()
+		r.wg.Done()
+	}
+	select {
+	case restoreQueue <- job:
+	case <-fr.ctx.Done():
+		<-fr.slots
+		fr.restores.Done()
+		r.wg.Done()
+		r.abandoned(fr)
+	}
+}
+
+func hasParent(f *drive.File, parentID string) bool {
+	for _, parent := range f.Parents {
+		if parent.Id == parentID {
+			return true
+		}
+	}
+	return false
+}
+
+// unlistedFolder is a folder that couldn't be listed, so its trashed
+// contents weren't restored.
+type unlistedFolder struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Error string `json:"error"`
+}
+
+// addUnlisted records a folder listing failure, to report it at the end
+// instead of stopping the run.
+func (r *restorer) addUnlisted(folderID, folderTitle string, err error) {
+	if r.abortError() != nil {
+		// cut short by the abort rather than unlistable
+		return
+	}
+	logError("Unable to list folder %q with name %q: %v", folderID, folderTitle, err)
+	r.unlistedMutex.Lock()
+	r.unlisted = append(r.unlisted, unlistedFolder{ID: folderID, Title: folderTitle, Error: err.Error()})
+	r.unlistedMutex.Unlock()
+}
+
+// rememberTrashed caches the trashed state of a folder seen in a listing.
+func (r *restorer) rememberTrashed(folderID string, trashed bool) {
+	r.trashedFoldersMutex.Lock()
+	r.trashedFolders[folderID] = trashed
+	r.trashedFoldersMutex.Unlock()
+}
+
+// hasTrashedParent reports whether any of the parents of f is trashed,
+// looking up parents that weren't seen in a listing yet.
+func (r *restorer) hasTrashedParent(f *drive.File) bool {
+	for _, parent := range f.Parents {
+		r.trashedFoldersMutex.Lock()
+		trashed, ok := r.trashedFolders[parent.Id]
+		r.trashedFoldersMutex.Unlock()
+		if !ok {
+			var pf *drive.File
+			err := p.Call(func() (bool, error) {
+				var err error
+				if !spendCall() {
+					return false, errBudgetExhausted
+				}
+				defer apiCalls.time("get")()
+				pf, err = r.srv.Files.Get(parent.Id).SupportsAllDrives(true).Fields("explicitlyTrashed, labels(trashed)").Context(r.ctx).Do()
+				return shouldRetry(err)
+			})
+			if err != nil {
+				logError("Unable to get parent %v of %v %v, assuming it's not trashed: %s%s", parent.Id, f.Id, f.Title, err, requestInfo(err))
+				continue
+			}
+			trashed = isTrashed(pf)
+			r.rememberTrashed(parent.Id, trashed)
+		}
+		if trashed {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *restorer) restoreFile(child *drive.File, folderID string) {
+	// a skipped duplicate mustn't bring its parents back either
+	if skipIfExists && r.isDuplicate(child, folderID) {
+		return
+	}
+	if restoreParents && r.hasTrashedParent(child) {
+		if err := r.restoreAncestors(child, nil); err != nil {
+			logError("Unable to restore the parents of %v %v in folder %v: %s%s", child.Id, child.Title, folderID, err, requestInfo(err))
+		}
+	}
+	if dryRun {
+		r.wouldRestoreMutex.Lock()
+		counted := r.wouldRestore[child.Id]
+		r.wouldRestore[child.Id] = true
+		r.wouldRestoreMutex.Unlock()
+		if counted {
+			return
+		}
+		if !dryRunByFolder && dryRunSample == 0 {
+			log.Printf("Would restore %v %v in folder %v", child.Id, child.Title, folderID)
+		}
+		r.report("would_restore", child, folderID, nil)
+		events.record("would_restore", child, folderID, nil)
+		r.addRestored(child)
+		atomic.AddUint64(&r.countBytes, uint64(child.FileSize))
+		return
+	}
+	if verbose {
+		log.Printf("Restoring %v %v in folder %v", child.Id, child.Title, folderID)
+	}
+	// folders have no revisions
+	revisions := -1
+	if verifyRevisions && child.MimeType != "application/vnd.google-apps.folder" {
+		var err error
+		revisions, err = r.countRevisions(child)
+		if err != nil {
+			logError("Unable to count revisions of %v %v, not verifying them: %s%s", child.Id, child.Title, err, requestInfo(err))
+			revisions = -1
+		}
+	}
+	var restored *drive.File
+	s := startSpan("untrash")
+	s.set("file.id", child.Id)
+	s.set("folder.id", folderID)
+	err := p.Call(func() (bool, error) {
+		if !spendCall() {
+			return false, errBudgetExhausted
+		}
+		s.attempt()
+		defer apiCalls.time("untrash")()
+		if err := simulatedFailure(); err != nil {
+			return shouldRetry(err)
+		}
+		var err error
+		restored, err = r.srv.Files.Untrash(child.Id).SupportsAllDrives(true).Fields("id, modifiedDate").Context(r.ctx).Do()
+		return shouldRetry(err)
+	})
+	s.finish(err)
+	if err == errBudgetExhausted {
+		atomic.AddUint64(&r.countNotAttempted, 1)
+	} else if err != nil && r.abortError() != nil {
+		// cancelled by the abort, or refused the same way
+		atomic.AddUint64(&r.countNotAttempted, 1)
+	} else if err != nil {
+		if serr := scopeError(err); serr != nil {
+			r.abort(serr)
+		}
+		logError("Failed to restore file %v %v in folder %v: %s%s", child.Id, child.Title, folderID, err, requestInfo(err))
+		r.countFailure(child, folderID, err)
+		events.record("failed", child, folderID, err)
+	} else {
+		if verbose {
+			log.Printf("Restored %v %v in folder %v", child.Id, child.Title, folderID)
+		}
+		r.addRestored(child)
+		atomic.AddUint64(&r.countBytes, uint64(child.FileSize))
+		restoredIDs.add(child.Id)
+		if sheetFiles {
+			r.report("restored", child, folderID, nil)
+		}
+		events.record("restored", child, folderID, nil)
+		if verifyMetadata && restored.ModifiedDate != child.ModifiedDate {
+			log.Printf("Restoring %v %v in folder %v changed its modified time from %v to %v", child.Id, child.Title, folderID, child.ModifiedDate, restored.ModifiedDate)
+			atomic.AddUint64(&r.countMetadataChanged, 1)
+		}
+		r.checkRevisions(child, folderID, revisions)
+		if verifyChecksum {
+			r.checkChecksum(child, folderID)
+		}
+		if tagRestored {
+			r.tagRestored(child)
+		}
+		if metadataDump != nil {
+			r.dumpMetadata(child)
+		}
+		if r.recoveryFolder != "" {
+			r.moveToRecovery(child, folderID)
+		}
+		if flattenTo != "" {
+			r.moveToFlattened(child, folderID)
+		}
+		if afterRestoreHook != "" {
+			hooks.queue(r.ctx, child, folderID)
+		}
+	}
+}
+
+// addRestored counts a restored file, logging every -milestone files and
+// sending the summary so far to the webhook.
+func (r *restorer) addRestored(f *drive.File) {
+	if f.MimeType == "application/vnd.google-apps.folder" {
+		atomic.AddUint64(&r.countRestoredFolders, 1)
+	} else {
+		atomic.AddUint64(&r.countRestoredFiles, 1)
+	}
+	n := atomic.AddUint64(&r.countRestored, 1)
+	if milestone == 0 || n%milestone != 0 {
+		return
+	}
+	if dryRun {
+		log.Printf("Would restore %d files so far", n)
+	} else {
+		log.Printf("Restored %d files so far", n)
+	}
+	if webhookURL != "" {
+		s := r.summary()
+		s.Milestone = n
+		// don't hold up the worker while the webhook is retried
+		milestoneWebhooks.Add(1)
+		go func() {
+			notifyWebhook(s)
+			milestoneWebhooks.Done()
+		}()
+	}
+}
+
+func (r *restorer) countFailure(f *drive.File, folderID string, err error) {
+	atomic.AddUint64(&r.countFailed, 1)
+	r.report("failed", f, folderID, err)
+}
+
+// failureBreakdown returns a summary like "3 permission, 1 not-found".
+func (r *restorer) failureBreakdown() string {
+	r.resultsMutex.Lock()
+	defer r.resultsMutex.Unlock()
+	var parts []string
+	for _, class := range failureClasses {
+		if n := r.failures[class]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, class))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (r *restorer) processFolder(folderId string, folderTitle string) error {
+	return r.walkFolder(nil, folderId, folderTitle)
+}
+
+// walkFolder is processFolder for a folder found in parent, which counts
+// as finished only once this one is. The caller added it to
+// parent.children.
+func (r *restorer) walkFolder(parent *folderRun, folderId string, folderTitle string) error {
+	if err := r.ctx.Err(); err != nil {
+		parent.childDone(false)
+		return err
+	}
+	r.seenMutex.Lock()
+	count := r.seen[folderId]
+	r.seen[folderId]++
+	r.seenMutex.Unlock()
+	if count > 0 {
+		if verbose {
+			log.Printf("Not processing folder ID \"%s\", already seen %d times, with name \"%s\"", folderId, count, folderTitle)
+		}
+		// it's finished wherever else it's walked from
+		parent.childDone(true)
+		return nil
+	}
+	atomic.AddUint64(&r.countFolders, 1)
+	if verbose {
+		log.Printf("Processing folder ID \"%s\", seen %d times, with name \"%s\"", folderId, count, folderTitle)
+	}
+	fr := r.newFolderRun(folderId, folderTitle, folderWorkersMax)
+	fr.parent = parent
+	listed := false
+	defer func() {
+		r.finishing.Add(1)
+		go func() {
+			// the watchdog is done once all the pages are handled
+			fr.pages.Wait()
+			fr.watchdog.stop()
+			fr.cancel()
+			fr.restores.Wait()
+			fr.children.Wait()
+			r.finishFolder(fr, listed)
+			r.finishing.Done()
+		}()
+	}()
+	for _, q := range folderQueries() {
+		var pageToken string
+		for {
+			var files []*drive.File
+			var err error
+			waitForMemory(fr.ctx)
+			fr.waitWhilePaused()
+			if stopRequested() {
+				return nil
+			}
+			files, pageToken, err = getFolderPage(fr.ctx, r.srv, folderId, q, pageToken)
+			if r.abandoned(fr) {
+				return nil
+			} else if err == errBudgetExhausted {
+				return err
+			} else if err != nil {
+				return fmt.Errorf("Failed to get file listing: %w", err)
+			}
+			r.wg.Add(1)
+			fr.pages.Add(1)
+			handle := func(folderId string, files []*drive.File) {
+				r.restoreTrashed(folderId, files, true, fr)
+				fr.pages.Done()
+				r.wg.Done()
+			}
+			if r.listSlots == nil {
+				go handle(folderId, files)
+			} else {
+				// waiting for a slot could deadlock with the folders above
+				// holding them all, so handle the page here if there's none
+				select {
+				case r.listSlots <- struct{}{}:
+					go func(folderId string, files []*drive.File) {
+						handle(folderId, files)
+						<-r.listSlots
+					}(folderId, files)
+				default:
+					handle(folderId, files)
+				}
+			}
+			// end of listing, that was last page
+			if pageToken == "" {
+				break
+			}
+		}
+	}
+	listed = true
+	return nil
+}
+
+// levelFolder is a folder to process at the next depth in -bfs mode,
+// found in parent.
+type levelFolder struct {
+	folder *drive.File
+	parent *folderRun
+}
+
+// processLevels walks the tree breadth-first starting at the given
+// folders, listing all the folders at one depth before going deeper.
+func (r *restorer) processLevels(folders []*drive.File) {
+	var level []levelFolder
+	for _, folder := range folders {
+		level = append(level, levelFolder{folder: folder})
+	}
+	// a level of a wide tree can have many thousands of folders
+	slots := r.listSlots
+	if slots == nil {
+		slots = make(chan struct{}, workers)
+	}
+	for depth := 0; len(level) > 0; depth++ {
+		if verbose {
+			log.Printf("Processing %d folders at depth %d", len(level), depth)
+		}
+		for _, lf := range level {
+			slots <- struct{}{}
+			r.wg.Add(1)
+			go func(lf levelFolder) {
+				err := r.walkFolder(lf.parent, lf.folder.Id, lf.folder.Title)
+				if err != nil && err != errBudgetExhausted {
+					r.addUnlisted(lf.folder.Id, lf.folder.Title, err)
+				}
+				<-slots
+				r.wg.Done()
+			}(lf)
+		}
+		r.wait()
+
+		r.nextLevelMutex.Lock()
+		level, r.nextLevel = r.nextLevel, nil
+		r.nextLevelMutex.Unlock()
+	}
+}
+
+// processTrash restores the trashed files matching q, listing them with a
+// single query instead of walking the folders.
+func (r *restorer) processTrash(q string) error {
+	// there are no folders to share the workers with, and no watchdog
+	fr := &folderRun{id: "trash", title: "trash", ctx: r.ctx, slots: make(chan struct{}, workers)}
+	var (
+		largest   []*drive.File
+		pageToken string
+	)
+	for {
+		var files []*drive.File
+		var err error
+		waitForMemory(r.ctx)
+		waitWhilePaused(r.ctx)
+		if stopRequested() {
+			break
+		}
+		files, pageToken, err = getPage(r.ctx, r.srv, q, pageToken)
+		if err == errBudgetExhausted {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Failed to get file listing: %w", err)
+		}
+		if largestFirst > 0 {
+			for _, f := range files {
+				f = r.completeFile(f, "root")
+				if f.ExplicitlyTrashed {
+					atomic.AddUint64(&r.countTrashedFound, 1)
+				}
+				if f.ExplicitlyTrashed && r.shouldRestore(f, "root") {
+					largest = append(largest, f)
+				}
+			}
+		} else {
+			r.wg.Add(1)
+			go func(files []*drive.File) {
+				r.restoreTrashed("", files, false, fr)
+				r.wg.Done()
+			}(files)
+		}
+		// end of listing, that was last page
+		if pageToken == "" {
+			break
+		}
+	}
+
+	if largestFirst > 0 {
+		sort.SliceStable(largest, func(i, j int) bool {
+			return largest[i].FileSize > largest[j].FileSize
+		})
+		if len(largest) > largestFirst {
+			largest = largest[:largestFirst]
+		}
+		for _, f := range largest {
+			r.enqueueRestore(f, "root", fr)
+		}
+	}
+	return nil
+}
+
+// reconcile restores the whole trash and lists it again, up to attempts
+// times, until nothing the filters would restore is left in it. This
+// handles sync clients trashing the files again after they're restored.
+// It reports whether the trash ended up empty of them.
+func (r *restorer) reconcile(attempts int) (bool, error) {
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err := r.processTrash("trashed = true"); err != nil {
+			return false, err
+		}
+		r.wait()
+		left, err := r.countTrash()
+		if err != nil {
+			return false, err
+		}
+		if left == 0 {
+			log.Printf("No trashed items to restore left after %d attempts", attempt)
+			return true, nil
+		}
+		log.Printf("%d trashed items to restore left after attempt %d of %d", left, attempt, attempts)
+	}
+	return false, nil
+}
+
+// countTrash returns the number of explicitly trashed items that the
+// filters would restore. The ones they skip stay in the trash for good.
+func (r *restorer) countTrash() (int, error) {
+	var (
+		count     int
+		pageToken string
+	)
+	for {
+		files, next, err := getPage(r.ctx, r.srv, "trashed = true", pageToken)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to get file listing: %w", err)
+		}
+		for _, f := range files {
+			if !f.ExplicitlyTrashed {
+				continue
+			}
+			if reason, _ := r.skipReason(f); reason == "" {
+				count++
+			}
+		}
+		pageToken = next
+		if pageToken == "" {
+			return count, nil
+		}
+	}
+}
+
+// processFiles restores the trashed files with the given IDs.
+func (r *restorer) processFiles(ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	fr := &folderRun{id: "files", title: "files", ctx: r.ctx, slots: make(chan struct{}, workers)}
+	var files []*drive.File
+	for _, id := range ids {
+		var f *drive.File
+		err := p.Call(func() (bool, error) {
+			if !spendCall() {
+				return false, errBudgetExhausted
+			}
+			defer apiCalls.time("get")()
+			var err error
+			f, err = r.srv.Files.Get(id).SupportsAllDrives(true).Fields(fileFields).Context(r.ctx).Do()
+			return shouldRetry(err)
+		})
+		if err != nil {
+			logError("Unable to get file %v: %s%s", id, err, requestInfo(err))
+			r.countFailure(&drive.File{Id: id}, "", err)
+			continue
+		}
+		if !f.ExplicitlyTrashed {
+			log.Printf("File %v %v is not in the trash anymore, not restoring it", f.Id, f.Title)
+		}
+		files = append(files, f)
+	}
+	r.restoreTrashed("", files, false, fr)
+}
+
+// wait waits for all the started listings and restores to finish.
+func (r *restorer) wait() {
+	r.wg.Wait()
+	r.syncResults()
+}
+
+// formatBytes formats n like "1.5 GB".
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
+
+// summary is the machine readable outcome of a run.
+type summary struct {
+	RunID              string               `json:"run_id"`
+	DryRun             bool                 `json:"dry_run"`
+	Folders            uint64               `json:"folders"`
+	TrashedFound       uint64               `json:"trashed_found"`
+	Restored           uint64               `json:"restored"`
+	RestoredFolders    uint64               `json:"restored_folders"`
+	RestoredFiles      uint64               `json:"restored_files"`
+	Bytes              uint64               `json:"bytes,omitempty"`
+	Failed             uint64               `json:"failed"`
+	Failures           map[string]uint64    `json:"failures,omitempty"`
+	SkippedMime        uint64               `json:"skipped_mime"`
+	SkippedExt         uint64               `json:"skipped_ext"`
+	SkippedInTrash     uint64               `json:"skipped_in_trash"`
+	SkippedParent      uint64               `json:"skipped_parent"`
+	SkippedRecent      uint64               `json:"skipped_recent"`
+	SkippedOrphan      uint64               `json:"skipped_orphan"`
+	SkippedTrashedBy   uint64               `json:"skipped_trashed_by"`
+	SkippedRestored    uint64               `json:"skipped_restored"`
+	SkippedSample      uint64               `json:"skipped_sample"`
+	SkippedDedup       uint64               `json:"skipped_dedup"`
+	SkippedCreated     uint64               `json:"skipped_created"`
+	SkippedDuplicate   uint64               `json:"skipped_duplicate"`
+	MetadataChanged    uint64               `json:"metadata_changed"`
+	RevisionsLost      uint64               `json:"revisions_lost"`
+	ChecksumMismatches uint64               `json:"checksum_mismatches"`
+	ParentsRestored    uint64               `json:"parents_restored,omitempty"`
+	NotAttempted       uint64               `json:"not_attempted"`
+	OverSizeBudget     uint64               `json:"over_size_budget,omitempty"`
+	FoldersPruned      uint64               `json:"folders_pruned"`
+	FoldersIncomplete  uint64               `json:"folders_incomplete"`
+	Unlisted           []unlistedFolder     `json:"unlisted_folders,omitempty"`
+	StillTrashed       []string             `json:"still_trashed,omitempty"`
+	APICalls           map[string]callStats `json:"api_calls"`
+	Milestone          uint64               `json:"milestone,omitempty"`
+	Error              string               `json:"error,omitempty"`
+}
+
+// status returns the main totals on a single line.
+func (s *summary) status() string {
+	return fmt.Sprintf("processed %d folders, restored %d folders and %d files, failed %d", s.Folders, s.RestoredFolders, s.RestoredFiles, s.Failed)
+}
+
+// summary returns the current totals of the run.
+func (r *restorer) summary() *summary {
+	s := &summary{
+		RunID:              runID,
+		DryRun:             dryRun,
+		Folders:            atomic.LoadUint64(&r.countFolders),
+		TrashedFound:       atomic.LoadUint64(&r.countTrashedFound),
+		Restored:           atomic.LoadUint64(&r.countRestored),
+		RestoredFolders:    atomic.LoadUint64(&r.countRestoredFolders),
+		RestoredFiles:      atomic.LoadUint64(&r.countRestoredFiles),
+		Bytes:              atomic.LoadUint64(&r.countBytes),
+		Failed:             atomic.LoadUint64(&r.countFailed),
+		Failures:           map[string]uint64{},
+		SkippedMime:        atomic.LoadUint64(&r.countSkippedMime),
+		SkippedExt:         atomic.LoadUint64(&r.countSkippedExt),
+		SkippedInTrash:     atomic.LoadUint64(&r.countSkippedInTrash),
+		SkippedParent:      atomic.LoadUint64(&r.countSkippedParent),
+		SkippedRecent:      atomic.LoadUint64(&r.countSkippedRecent),
+		SkippedOrphan:      atomic.LoadUint64(&r.countSkippedOrphan),
+		SkippedTrashedBy:   atomic.LoadUint64(&r.countSkippedTrashedBy),
+		SkippedRestored:    atomic.LoadUint64(&r.countSkippedRestored),
+		SkippedSample:      atomic.LoadUint64(&r.countSkippedSample),
+		SkippedDedup:       atomic.LoadUint64(&r.countSkippedDedup),
+		SkippedCreated:     atomic.LoadUint64(&r.countSkippedCreated),
+		SkippedDuplicate:   atomic.LoadUint64(&r.countSkippedDuplicate),
+		MetadataChanged:    atomic.LoadUint64(&r.countMetadataChanged),
+		RevisionsLost:      atomic.LoadUint64(&r.countRevisionsLost),
+		ChecksumMismatches: atomic.LoadUint64(&r.countChecksumMismatch),
+		ParentsRestored:    atomic.LoadUint64(&r.countParentsRestored),
+		NotAttempted:       atomic.LoadUint64(&r.countNotAttempted),
+		OverSizeBudget:     atomic.LoadUint64(&r.countOverSizeBudget),
+		FoldersPruned:      atomic.LoadUint64(&r.countFoldersPruned),
+		FoldersIncomplete:  atomic.LoadUint64(&r.countFoldersIncomplete),
+		APICalls:           apiCalls.snapshot(),
+	}
+	r.resultsMutex.Lock()
+	for class, n := range r.failures {
+		s.Failures[class] = n
+	}
+	r.resultsMutex.Unlock()
+	r.unlistedMutex.Lock()
+	s.Unlisted = append(s.Unlisted, r.unlisted...)
+	r.unlistedMutex.Unlock()
+	return s
+}
+
+// logSummary logs the totals of the run.
+func (r *restorer) logSummary() {
+	log.Printf("Processed %d folders in total", r.countFolders)
+	if len(r.unlisted) > 0 {
+		logError("Unable to list %d folders, their trashed files weren't restored:", len(r.unlisted))
+		for _, f := range r.unlisted {
+			log.Printf("  %s %s: %s", f.ID, f.Title, f.Error)
+		}
+	}
+	if r.countFoldersIncomplete > 0 {
+		log.Printf("Abandoned %d folders for taking longer than %v", r.countFoldersIncomplete, folderTimeout)
+	}
+	if !folderCutoff.IsZero() {
+		log.Printf("Skipped %d folders last modified before %v", r.countFoldersPruned, folderCutoff)
+	}
+	if r.countTrashedFound == 0 && len(r.unlisted) == 0 {
+		log.Printf("No trashed files found in the scanned scope")
+	}
+	if dryRun {
+		if dryRunByFolder {
+			r.logGroups()
+		}
+		for _, line := range r.sample {
+			log.Print(line)
+		}
+		if dryRunSample > 0 {
+			log.Printf("Logged a random sample of %d of the files that would be restored", len(r.sample))
+		}
+		log.Printf("Would restore %d items totaling %s, %d folders and %d files", r.countRestored, formatBytes(int64(r.countBytes)), r.countRestoredFolders, r.countRestoredFiles)
+	} else {
+		log.Printf("Restored %d items totaling %s, %d folders and %d files", r.countRestored, formatBytes(int64(r.countBytes)), r.countRestoredFolders, r.countRestoredFiles)
+	}
+	if r.countFailed > 0 {
+		logError("Failed to restore %d files: %s", r.countFailed, r.failureBreakdown())
+		r.resultsMutex.Lock()
+		notOwner := r.failures["not-owner"]
+		r.resultsMutex.Unlock()
+		if corpora == "domain" && notOwner > 0 {
+			log.Printf("%d of the files shared to the domain can only be restored by their owners", notOwner)
+		}
+	}
+	if len(excludeMime) > 0 {
+		log.Printf("Skipped %d files excluded by -exclude-mime", r.countSkippedMime)
+	}
+	if len(includeExt) > 0 || len(excludeExt) > 0 {
+		log.Printf("Skipped %d files excluded by -ext or -exclude-ext", r.countSkippedExt)
+	}
+	if skipOrphans {
+		r.logOrphans()
+	}
+	if trashedBy != "" {
+		log.Printf("Skipped %d files not trashed by %v", r.countSkippedTrashedBy, trashedBy)
+	}
+	if restoredIDsDir != "" {
+		log.Printf("Skipped %d files restored by earlier runs", r.countSkippedRestored)
+	}
+	if samplePercent < 100 {
+		log.Printf("Skipped %d files outside of the %v%% sample", r.countSkippedSample, samplePercent)
+	}
+	if dedupRestore != "" {
+		log.Printf("Skipped %d trashed duplicates of newer files", r.countSkippedDedup)
+	}
+	if rootsOnly {
+		log.Printf("Skipped %d files inside trashed folders", r.countSkippedInTrash)
+	}
+	if minTrashedAge > 0 {
+		log.Printf("Skipped %d files trashed less than %v ago", r.countSkippedRecent, minTrashedAge)
+	}
+	if !createdAfter.IsZero() || !createdBefore.IsZero() {
+		log.Printf("Skipped %d files created outside of -created-after and -created-before", r.countSkippedCreated)
+	}
+	if skipIfExists {
+		log.Printf("Skipped %d files that already have a copy in their folder", r.countSkippedDuplicate)
+	}
+	if wasInParent != "" {
+		log.Printf("Skipped %d files that weren't in folder %v", r.countSkippedParent, wasInParent)
+	}
+	if restoreParents {
+		log.Printf("Restored %d trashed parent folders", r.countParentsRestored)
+	}
+	if verifyRevisions {
+		log.Printf("Restores of %d files lost revisions", r.countRevisionsLost)
+	}
+	if verifyChecksum {
+		log.Printf("Restores of %d files failed the checksum verification", r.countChecksumMismatch)
+	}
+	if budgetExhausted() {
+		log.Printf("Didn't restore %d files because of the API call budget", r.countNotAttempted)
+	}
+	if sizeBudget > 0 {
+		log.Printf("Left %d files out of the -size-budget of %s", r.countOverSizeBudget, formatBytes(sizeBudget*1000*1000))
+	}
+	if verifyMetadata {
+		log.Printf("Restores of %d files changed their modified time", r.countMetadataChanged)
+	}
+	stats := apiCalls.snapshot()
+	kinds := make([]string, 0, len(stats))
+	for kind := range stats {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		log.Printf("API %s: %v", kind, stats[kind])
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/rclone/rclone/lib/pacer"
+	drive "google.golang.org/api/drive/v2"
+	"google.golang.org/api/option"
+)
+
+// fakeDrive serves the listings of a folder tree and the files in it like
+// the Drive API does, with some folders slow to list or get.
+type fakeDrive struct {
+	children map[string][]*drive.File
+	files    map[string]*drive.File
+	slow     map[string]time.Duration
+
+	mu     sync.Mutex
+	listed map[string]int
+}
+
+var inParents = regexp.MustCompile(`'([^']*)' in parents`)
+
+func (d *fakeDrive) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if id := strings.TrimPrefix(req.URL.Path, "/files/"); id != req.URL.Path {
+		d.get(w, req, id)
+		return
+	}
+	var parent string
+	if m := inParents.FindStringSubmatch(req.URL.Query().Get("q")); m != nil {
+		parent = m[1]
+	}
+	d.mu.Lock()
+	d.listed[parent]++
+	d.mu.Unlock()
+	if !d.wait(req, parent) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&drive.FileList{Items: d.children[parent]})
+}
+
+func (d *fakeDrive) get(w http.ResponseWriter, req *http.Request, id string) {
+	f, ok := d.files[id]
+	if !ok {
+		http.Error(w, `{"error": {"code": 404}}`, http.StatusNotFound)
+		return
+	}
+	if !d.wait(req, id) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
+
+// wait waits for as long as id is slow, reporting whether the request is
+// still there.
+func (d *fakeDrive) wait(req *http.Request, id string) bool {
+	select {
+	case <-time.After(d.slow[id]):
+		return true
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+func (d *fakeDrive) timesListed(id string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.listed[id]
+}
+
+func folder(id string) *drive.File {
+	return &drive.File{Id: id, Title: id, MimeType: "application/vnd.google-apps.folder", Labels: &drive.FileLabels{}}
+}
+
+func trashedFile(id, parent string, size int64) *drive.File {
+	return &drive.File{
+		Id:                id,
+		Title:             id,
+		MimeType:          "text/plain",
+		FileSize:          size,
+		ExplicitlyTrashed: true,
+		Labels:            &drive.FileLabels{Trashed: true},
+		Parents:           []*drive.ParentReference{{Id: parent}},
+		TrashedDate:       "2026-01-02T00:00:00Z",
+		ModifiedDate:      "2026-01-01T00:00:00Z",
+	}
+}
+
+// wholeDrive is a drive with two trashed files of 1 MB in a folder, that
+// the whole-drive walk lists twice: in the folder, and in the listing
+// without a parent, which takes in everything trashed.
+func wholeDrive() *fakeDrive {
+	f1, f2 := trashedFile("f1", "S", 1000*1000), trashedFile("f2", "S", 1000*1000)
+	return &fakeDrive{
+		children: map[string][]*drive.File{"": {folder("S"), f1, f2}, "S": {f1, f2}},
+		listed:   map[string]int{},
+	}
+}
+
+// setDefaults sets the flags the tests depend on to their defaults, which
+// only flag.Parse applies, until the end of the test.
+func setDefaults(t *testing.T) {
+	order, percent, perFolder, depth := restoreOrder, samplePercent, folderWorkersMax, maxParentsDepth
+	t.Cleanup(func() {
+		restoreOrder, samplePercent, folderWorkersMax, maxParentsDepth = order, percent, perFolder, depth
+	})
+	restoreOrder, samplePercent, folderWorkersMax, maxParentsDepth = "none", 100, 20, 100
+}
+
+// newTestRestorer returns a restorer using a Drive server serving d, with
+// the flags at their defaults.
+func newTestRestorer(t *testing.T, d *fakeDrive) *restorer {
+	setDefaults(t)
+	ts := httptest.NewServer(d)
+	t.Cleanup(ts.Close)
+	srv, err := drive.NewService(context.Background(), option.WithHTTPClient(ts.Client()), option.WithEndpoint(ts.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil {
+		p = &retryPacer{pacer.New()}
+		startWorkers(4)
+	}
+	return newRestorer(context.Background(), srv)
+}
+
+func TestSlowSubfolderDoesntAbandonParent(t *testing.T) {
+	defer func(d time.Duration) { folderTimeout = d }(folderTimeout)
+	folderTimeout = 300 * time.Millisecond
+
+	d := &fakeDrive{
+		children: map[string][]*drive.File{"A": {folder("B"), folder("C")}},
+		slow:     map[string]time.Duration{"B": 500 * time.Millisecond},
+		listed:   map[string]int{},
+	}
+	r := newTestRestorer(t, d)
+	if err := r.processFolder("A", "A"); err != nil {
+		t.Fatal(err)
+	}
+	r.wait()
+	r.finishing.Wait()
+
+	if r.countFolders != 3 {
+		t.Errorf("walked %d folders, want 3", r.countFolders)
+	}
+	// only the slow folder itself is abandoned
+	if r.countFoldersIncomplete != 1 {
+		t.Errorf("%d folders incomplete, want 1", r.countFoldersIncomplete)
+	}
+	if n := d.timesListed("C"); n != 1 {
+		t.Errorf("sibling listed %d times, want 1", n)
+	}
+}
+
+// walk walks the whole drive and waits for the restores to finish.
+func walk(t *testing.T, r *restorer) {
+	if err := r.processFolder("", "/"); err != nil {
+		t.Fatal(err)
+	}
+	r.wait()
+	r.finishing.Wait()
+}
+
+func TestPlanListsFilesOnce(t *testing.T) {
+	defer func(d bool, out string) { dryRun, planOut = d, out }(dryRun, planOut)
+	dryRun = true
+	planOut = filepath.Join(t.TempDir(), "plan.json")
+
+	r := newTestRestorer(t, wholeDrive())
+	walk(t, r)
+	if err := r.writePlan(planOut); err != nil {
+		t.Fatal(err)
+	}
+	files, err := readPlan(planOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("plan has %d files, want 2: %v", len(files), files)
+	}
+}
+
+func TestDryRunCountsFilesOnce(t *testing.T) {
+	defer func(d bool) { dryRun = d }(dryRun)
+	dryRun = true
+
+	r := newTestRestorer(t, wholeDrive())
+	walk(t, r)
+	if r.countRestored != 2 || r.countBytes != 2*1000*1000 {
+		t.Errorf("would restore %d items totaling %d bytes, want 2 and 2000000", r.countRestored, r.countBytes)
+	}
+}
+
+func TestHeldRestoresOnce(t *testing.T) {
+	r := newTestRestorer(t, wholeDrive())
+	restoreOrder = "fifo"
+	walk(t, r)
+	if len(r.held) != 2 {
+		t.Errorf("held %d restores, want 2", len(r.held))
+	}
+}
+
+func TestRestoreAncestorsLoop(t *testing.T) {
+	defer func(d bool) { dryRun = d }(dryRun)
+	dryRun = true
+
+	// X and Y are each other's parent, and both trashed
+	x, y := trashedFile("X", "Y", 0), trashedFile("Y", "X", 0)
+	x.MimeType, y.MimeType = "application/vnd.google-apps.folder", "application/vnd.google-apps.folder"
+	d := &fakeDrive{
+		files: map[string]*drive.File{"X": x, "Y": y},
+		// so that both restores are on their way before either gets further
+		slow:   map[string]time.Duration{"X": 100 * time.Millisecond, "Y": 100 * time.Millisecond},
+		listed: map[string]int{},
+	}
+	r := newTestRestorer(t, d)
+	errs := make(chan error, 2)
+	for _, f := range []*drive.File{trashedFile("a", "X", 0), trashedFile("b", "Y", 0)} {
+		go func(f *drive.File) { errs <- r.restoreAncestors(f, nil) }(f)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Errorf("restored the ancestors of a loop without an error")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("restoring the ancestors of a loop from both ends deadlocked")
+		}
+	}
+}
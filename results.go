@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// resultsBuffer is how many results can be waiting for the collector
+// before the workers block.
+const resultsBuffer = 1000
+
+// result is an outcome of handling a file, for the collector to add to the
+// aggregates that the report is made of.
+type result struct {
+	// kind is one of "would_restore", "restored", "failed",
+	// "intended", "left_alone" and "orphan"
+	kind     string
+	file     *drive.File
+	folderID string
+	err      error
+	// done is closed by the collector once it's got all the results
+	// sent before, the other fields are unset then
+	done chan struct{}
+}
+
+// report hands a result over to the collector.
+func (r *restorer) report(kind string, f *drive.File, folderID string, err error) {
+	r.results <- result{kind: kind, file: f, folderID: folderID, err: err}
+}
+
+// syncResults waits until the collector got all the results reported
+// so far.
+func (r *restorer) syncResults() {
+	done := make(chan struct{})
+	r.results <- result{done: done}
+	<-done
+}
+
+// collect adds up the results until the restorer is closed. It's the only
+// writer of the aggregates, which are read under resultsMutex.
+func (r *restorer) collect() {
+	for res := range r.results {
+		if res.done != nil {
+			close(res.done)
+			continue
+		}
+		r.resultsMutex.Lock()
+		r.apply(res)
+		r.resultsMutex.Unlock()
+	}
+}
+
+func (r *restorer) apply(res result) {
+	if sheetFiles && (res.kind == "would_restore" || res.kind == "restored" || res.kind == "failed") {
+		row := fileRow{outcome: res.kind, id: res.file.Id, title: res.file.Title, mimeType: res.file.MimeType, folderID: res.folderID}
+		if res.err != nil {
+			row.err = res.err.Error()
+		}
+		r.sheetRows = append(r.sheetRows, row)
+	}
+	switch res.kind {
+	case "would_restore":
+		if dryRunByFolder {
+			r.groups[res.folderID] = append(r.groups[res.folderID], res.file)
+		} else if dryRunSample > 0 {
+			r.addToSample(fmt.Sprintf("Would restore %v %v in folder %v", res.file.Id, res.file.Title, res.folderID))
+		}
+		if _, ok := r.plan[res.file.Id]; !ok && planOut != "" {
+			r.plan[res.file.Id] = newPlanFile(res.file)
+		}
+	case "failed":
+		r.failures[classifyError(res.err)]++
+	case "intended":
+		r.intended[res.file.Id] = true
+		if _, ok := r.planOrder[res.file.Id]; !ok && planOut != "" {
+			r.planOrder[res.file.Id] = len(r.planOrder)
+		}
+	case "left_alone":
+		r.intended[res.file.Id] = false
+	case "orphan":
+		r.orphans = append(r.orphans, res.file)
+	}
+}
+
+// addToSample keeps a uniformly random sample of dryRunSample lines out of
+// all the lines it was given, using reservoir sampling.
+func (r *restorer) addToSample(line string) {
+	r.sampleSeen++
+	if len(r.sample) < dryRunSample {
+		r.sample = append(r.sample, line)
+	} else if i := r.sampleRand.Int63n(r.sampleSeen); i < int64(dryRunSample) {
+		r.sample[i] = line
+	}
+}
+
+// close stops the collector, the restorer can't be used for restoring
+// after that, only for its summary.
+func (r *restorer) close() {
+	r.wait()
+	close(r.results)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/rclone/rclone/lib/pacer"
+)
+
+// extraPacerRetries is added to the sum of the per-reason limits to make
+// up the retries of the pacer itself. shouldRetry only retries errors that
+// have a reason with a limit of its own, so the pacer never runs out
+// first. The pauses of -pause-on-quota don't count, see retryPacer.Call.
+const extraPacerRetries = 50
+
+// maxRateLimitBackoff caps the doubling of -ratelimit-backoff.
+const maxRateLimitBackoff = time.Minute
+
+// rateLimitBackoff returns how long to wait before the nth retry of a
+// rate limited call: -ratelimit-backoff, doubling with each retry.
+func rateLimitBackoff(n int) time.Duration {
+	d := rateLimitBackoffBase
+	for i := 1; i < n && d < maxRateLimitBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRateLimitBackoff {
+		d = maxRateLimitBackoff
+	}
+	return d
+}
+
+// retryPacer is a pacer that also limits the retries of each call by
+// their reason, on top of the retries of the pacer itself.
+type retryPacer struct {
+	*pacer.Pacer
+}
+
+// retryReason returns why shouldRetry retried err: "5xx", "ratelimit",
+// "network", "quota" after a -pause-on-quota pause, or "" for the other
+// reasons, which only the pacer limits.
+func retryReason(err error) string {
+	if gerr, ok := googleError(err); ok {
+		switch {
+		case len(gerr.Errors) > 0 && gerr.Errors[0].Reason == "dailyLimitExceeded":
+			return "quota"
+		case gerr.Code == http.StatusTooManyRequests:
+			return "ratelimit"
+		case gerr.Code >= 500 && gerr.Code < 600:
+			return "5xx"
+		case len(gerr.Errors) > 0 && (gerr.Errors[0].Reason == "rateLimitExceeded" || gerr.Errors[0].Reason == "userRateLimitExceeded"):
+			return "ratelimit"
+		}
+		return ""
+	}
+	if isTransientNetError(err) {
+		return "network"
+	}
+	return ""
+}
+
+// retryLimit returns how many times a call is retried for reason.
+func retryLimit(reason string) (int, bool) {
+	switch reason {
+	case "5xx":
+		return retries5xx, true
+	case "ratelimit":
+		return retriesRateLimit, true
+	case "network":
+		return retriesNetwork, true
+	}
+	return 0, false
+}
+
+// Call is pacer.Call, giving up once fn was retried for a reason as many
+// times as -retries-5xx, -retries-ratelimit or -retries-network allow.
+//
+// A retry after a -pause-on-quota pause starts over with a fresh call of
+// the pacer, so that the pause neither counts as a retry nor backs off.
+func (p *retryPacer) Call(fn pacer.Paced) error {
+	for {
+		paused := false
+		err := p.call(fn, &paused)
+		if !paused {
+			return err
+		}
+	}
+}
+
+func (p *retryPacer) call(fn pacer.Paced, paused *bool) error {
+	retries := map[string]int{}
+	return p.Pacer.Call(func() (bool, error) {
+		retry, err := fn()
+		if !retry {
+			return false, err
+		}
+		reason := retryReason(err)
+		if reason == "quota" {
+			*paused = true
+			return false, err
+		}
+		limit, ok := retryLimit(reason)
+		if !ok {
+			return true, err
+		}
+		retries[reason]++
+		if retries[reason] > limit {
+			if verbose {
+				logError("Giving up after %d retries for %s errors: %v", limit, reason, err)
+			}
+			return false, err
+		}
+		if _, ok := pacer.IsRetryAfter(err); reason == "ratelimit" && !ok && rateLimitBackoffBase > 0 {
+			// the pacer's own backoff tops out at a couple of seconds
+			err = pacer.RetryAfterError(err, rateLimitBackoff(retries[reason]))
+		}
+		return true, err
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+
+	"golang.org/x/net/context"
+)
+
+// Finished jobs are kept for GET /jobs/<id> for this long, and at most
+// this many of them.
+const (
+	finishedJobTTL   = 24 * time.Hour
+	finishedJobsKept = 100
+)
+
+// restoreRequest is the body of POST /restore.
+type restoreRequest struct {
+	FolderIDs []string `json:"folder_ids"`
+	FileIDs   []string `json:"file_ids"`
+}
+
+// job is a restore run started over HTTP.
+type job struct {
+	ID       string     `json:"id"`
+	Status   string     `json:"status"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Summary  *summary   `json:"summary"`
+
+	r *restorer
+}
+
+// server runs restore jobs, sharing the worker pool and the pacer.
+type server struct {
+	ctx context.Context
+	srv *drive.Service
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+// serve serves the HTTP API on addr until it fails.
+func serve(ctx context.Context, srv *drive.Service, addr string) error {
+	s := &server{ctx: ctx, srv: srv, jobs: map[string]*job{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/restore", s.handleRestore)
+	mux.HandleFunc("/jobs/", s.handleJob)
+	log.Printf("Serving restore API on %s", addr)
+	return http.ListenAndServe(addr, authorize(mux))
+}
+
+// isLoopback reports whether addr only listens on the local host.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authorize lets the requests through to h only if they carry the
+// -serve-token, if there is one.
+func authorize(h http.Handler) http.Handler {
+	if serveToken == "" {
+		return h
+	}
+	want := []byte("Bearer " + serveToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or wrong bearer token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// evictJobs forgets the finished jobs past finishedJobTTL, and the oldest
+// ones past finishedJobsKept, with s.mu held.
+func (s *server) evictJobs(now time.Time) {
+	var finished []*job
+	for id, j := range s.jobs {
+		if j.Finished == nil {
+			continue
+		}
+		if now.Sub(*j.Finished) > finishedJobTTL {
+			delete(s.jobs, id)
+			continue
+		}
+		finished = append(finished, j)
+	}
+	if len(finished) <= finishedJobsKept {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].Finished.Before(*finished[j].Finished)
+	})
+	for _, j := range finished[:len(finished)-finishedJobsKept] {
+		delete(s.jobs, j.ID)
+	}
+}
+
+func (s *server) handleRestore(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var rr restoreRequest
+	if err := json.NewDecoder(req.Body).Decode(&rr); err != nil {
+		http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(rr.FolderIDs) == 0 && len(rr.FileIDs) == 0 {
+		http.Error(w, "no folder_ids or file_ids given", http.StatusBadRequest)
+		return
+	}
+	folderIDs, err := parseIDs(rr.FolderIDs)
+	if err == nil {
+		rr.FileIDs, err = parseIDs(rr.FileIDs)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	folders, err := checkFolders(s.srv, folderIDs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	j := &job{ID: newJobID(), Status: "running", Started: time.Now().UTC(), r: newRestorer(s.ctx, s.srv)}
+	s.mu.Lock()
+	s.evictJobs(time.Now().UTC())
+	s.jobs[j.ID] = j
+	s.mu.Unlock()
+	log.Printf("Starting job %s restoring %d folders and %d files", j.ID, len(folders), len(rr.FileIDs))
+	go s.run(j, folders, rr.FileIDs)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"id": j.ID})
+}
+
+func (s *server) run(j *job, folders []*drive.File, fileIDs []string) {
+	r := j.r
+	for _, folder := range folders {
+		r.rememberTrashed(folder.Id, isTrashed(folder))
+		err := r.processFolder(folder.Id, folder.Title)
+		if err != nil && err != errBudgetExhausted {
+			r.addUnlisted(folder.Id, folder.Title, err)
+		}
+	}
+	r.processFiles(fileIDs)
+	r.close()
+
+	log.Printf("Job %s finished", j.ID)
+	r.logSummary()
+	finished := time.Now().UTC()
+	s.mu.Lock()
+	j.Status = "done"
+	if err := r.abortError(); err != nil {
+		j.Status = "failed"
+		j.Error = err.Error()
+	}
+	j.Finished = &finished
+	s.mu.Unlock()
+}
+
+func (s *server) handleJob(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(req.URL.Path, "/jobs/")
+	s.mu.Lock()
+	j, ok := s.jobs[id]
+	var status job
+	if ok {
+		status = *j
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "no such job", http.StatusNotFound)
+		return
+	}
+	// the summary is live while the job runs
+	status.Summary = j.r.summary()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&status)
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		fatalf(nil, "Unable to generate job ID: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
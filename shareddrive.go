@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// checkSharedDrive verifies that the shared drive id exists and that the
+// user can take files out of its trash, which only its managers and
+// content managers can.
+func checkSharedDrive(srv *drive.Service, id string) error {
+	var d *drive.Drive
+	err := p.Call(func() (bool, error) {
+		defer apiCalls.time("get")()
+		var err error
+		d, err = srv.Drives.Get(id).Fields("id, name, capabilities(canListChildren, canTrashChildren)").Do()
+		return shouldRetry(err)
+	})
+	if err != nil {
+		if gerr, ok := googleError(err); ok && gerr.Code == http.StatusNotFound {
+			return codedError{exitNoAccess, fmt.Errorf("shared drive %q doesn't exist or you're not a member of it", id)}
+		}
+		return codedError{exitNoAccess, fmt.Errorf("unable to access shared drive %q: %v%s", id, err, requestInfo(err))}
+	}
+	log.Printf("Restoring the trash of shared drive %q (%s)", d.Name, d.Id)
+	if d.Capabilities == nil || !d.Capabilities.CanListChildren {
+		return codedError{exitNoAccess, fmt.Errorf("unable to list the files of shared drive %q", d.Name)}
+	}
+	if !d.Capabilities.CanTrashChildren {
+		if dryRun {
+			logError("Only managers and content managers of shared drive %q can restore its trash, you aren't one", d.Name)
+			return nil
+		}
+		return codedError{exitNoAccess, fmt.Errorf("only managers and content managers of shared drive %q can restore its trash, you aren't one", d.Name)}
+	}
+	return nil
+}
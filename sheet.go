@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	sheets "google.golang.org/api/sheets/v4"
+)
+
+// sheetChunk is how many rows of files go in a single update, to keep
+// the requests small.
+const sheetChunk = 5000
+
+// fileRow is a file handled by the run, for the Files sheet of
+// -sheet-output.
+type fileRow struct {
+	outcome, id, title, mimeType, folderID, err string
+}
+
+// summaryRows returns the fields of s as rows of name and value, the
+// nested ones as JSON.
+func summaryRows(s *summary) ([][]interface{}, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rows := [][]interface{}{{"field", "value"}}
+	for _, name := range names {
+		var value interface{}
+		if err := json.Unmarshal(fields[name], &value); err != nil {
+			return nil, err
+		}
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			value = string(fields[name])
+		}
+		rows = append(rows, []interface{}{name, value})
+	}
+	return rows, nil
+}
+
+// writeSheet creates a spreadsheet titled title with the summary of the
+// run, and with -sheet-files the files it handled, and returns its URL.
+func (r *restorer) writeSheet(client *http.Client, title string, s *summary) (string, error) {
+	svc, err := sheets.New(client)
+	if err != nil {
+		return "", err
+	}
+	tabs := []*sheets.Sheet{{Properties: &sheets.SheetProperties{Title: "Summary"}}}
+	if sheetFiles {
+		tabs = append(tabs, &sheets.Sheet{Properties: &sheets.SheetProperties{Title: "Files"}})
+	}
+	var created *sheets.Spreadsheet
+	err = p.Call(func() (bool, error) {
+		defer apiCalls.time("sheets")()
+		var err error
+		created, err = svc.Spreadsheets.Create(&sheets.Spreadsheet{
+			Properties: &sheets.SpreadsheetProperties{Title: title},
+			Sheets:     tabs,
+		}).Context(r.ctx).Do()
+		return shouldRetry(err)
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to create the spreadsheet: %w", err)
+	}
+	rows, err := summaryRows(s)
+	if err != nil {
+		return "", err
+	}
+	if err := r.updateSheet(svc, created.SpreadsheetId, "Summary!A1", rows); err != nil {
+		return created.SpreadsheetUrl, err
+	}
+	if !sheetFiles {
+		return created.SpreadsheetUrl, nil
+	}
+	r.resultsMutex.Lock()
+	files := r.sheetRows
+	r.resultsMutex.Unlock()
+	header := []interface{}{"outcome", "id", "title", "mime_type", "folder", "error"}
+	for start := 0; start == 0 || start < len(files); start += sheetChunk {
+		// the header takes up the first row
+		var rows [][]interface{}
+		at := fmt.Sprintf("Files!A%d", start+2)
+		if start == 0 {
+			rows = append(rows, header)
+			at = "Files!A1"
+		}
+		end := start + sheetChunk
+		if end > len(files) {
+			end = len(files)
+		}
+		for _, f := range files[start:end] {
+			rows = append(rows, []interface{}{f.outcome, f.id, f.title, f.mimeType, f.folderID, f.err})
+		}
+		if err := r.updateSheet(svc, created.SpreadsheetId, at, rows); err != nil {
+			return created.SpreadsheetUrl, err
+		}
+	}
+	return created.SpreadsheetUrl, nil
+}
+
+func (r *restorer) updateSheet(svc *sheets.Service, id, at string, rows [][]interface{}) error {
+	err := p.Call(func() (bool, error) {
+		defer apiCalls.time("sheets")()
+		_, err := svc.Spreadsheets.Values.Update(id, at, &sheets.ValueRange{Values: rows}).ValueInputOption("RAW").Context(r.ctx).Do()
+		return shouldRetry(err)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write %s: %w", at, err)
+	}
+	return nil
+}
+
+// exportSheet writes the -sheet-output spreadsheet, logging where it is.
+func (r *restorer) exportSheet(client *http.Client, s *summary) {
+	url, err := r.writeSheet(client, sheetOutput, s)
+	if err != nil {
+		logError("Unable to write -sheet-output: %v%s", err, requestInfo(err))
+		if url != "" {
+			log.Printf("What was written is in %s", url)
+		}
+		return
+	}
+	log.Printf("Wrote the summary to %s", url)
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// logStatusOnSignal logs the current totals of r whenever the process gets
+// a SIGUSR1.
+func logStatusOnSignal(r *restorer) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			log.Printf("Status: %s", r.summary().status())
+		}
+	}()
+}
@@ -0,0 +1,4 @@
+package main
+
+// logStatusOnSignal does nothing, there's no SIGUSR1 on Windows.
+func logStatusOnSignal(r *restorer) {}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histogram buckets.
+var latencyBuckets = []time.Duration{
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// callStats are the counts and latencies of one kind of API call.
+type callStats struct {
+	Calls uint64        `json:"calls"`
+	Total time.Duration `json:"total_ns"`
+	Max   time.Duration `json:"max_ns"`
+	// Buckets counts the calls per latency bucket, the last one counting
+	// the calls slower than all the latencyBuckets.
+	Buckets []uint64 `json:"buckets"`
+}
+
+// apiStats records the API calls made, by kind of call.
+type apiStats struct {
+	mu    sync.Mutex
+	kinds map[string]*callStats
+}
+
+var apiCalls = &apiStats{kinds: map[string]*callStats{}}
+
+func init() {
+	// served along with pprof under /debug/vars
+	expvar.Publish("api_calls", expvar.Func(func() interface{} {
+		return apiCalls.snapshot()
+	}))
+}
+
+// time starts timing a call of the given kind, the returned function
+// records it.
+func (s *apiStats) time(kind string) func() {
+	start := time.Now()
+	return func() {
+		s.record(kind, time.Since(start))
+	}
+}
+
+func (s *apiStats) record(kind string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cs := s.kinds[kind]
+	if cs == nil {
+		cs = &callStats{Buckets: make([]uint64, len(latencyBuckets)+1)}
+		s.kinds[kind] = cs
+	}
+	cs.Calls++
+	cs.Total += d
+	if d > cs.Max {
+		cs.Max = d
+	}
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	cs.Buckets[i]++
+}
+
+// snapshot returns a copy of the stats safe to use without the lock.
+func (s *apiStats) snapshot() map[string]callStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make(map[string]callStats, len(s.kinds))
+	for kind, cs := range s.kinds {
+		c := *cs
+		c.Buckets = append([]uint64(nil), cs.Buckets...)
+		m[kind] = c
+	}
+	return m
+}
+
+// String formats the stats for logging.
+func (cs callStats) String() string {
+	var avg time.Duration
+	if cs.Calls > 0 {
+		avg = cs.Total / time.Duration(cs.Calls)
+	}
+	s := fmt.Sprintf("%d calls, avg %v, max %v, latencies", cs.Calls, avg.Round(time.Millisecond), cs.Max.Round(time.Millisecond))
+	for i, n := range cs.Buckets {
+		if i < len(latencyBuckets) {
+			s += fmt.Sprintf(" <=%v: %d", latencyBuckets[i], n)
+		} else {
+			s += fmt.Sprintf(" >%v: %d", latencyBuckets[i-1], n)
+		}
+	}
+	return s
+}
+
+var (
+	maxAPICalls uint64
+	// apiCallsSpent counts the calls made against maxAPICalls
+	apiCallsSpent uint64
+)
+
+var errBudgetExhausted = errors.New("API call budget exhausted")
+
+// spendCall accounts for one more API call, returning false if that would
+// go over the -max-api-calls budget.
+func spendCall() bool {
+	if maxAPICalls == 0 {
+		return true
+	}
+	return atomic.AddUint64(&apiCallsSpent, 1) <= maxAPICalls
+}
+
+// budgetExhausted reports whether calls were refused because of the budget.
+func budgetExhausted() bool {
+	return maxAPICalls > 0 && atomic.LoadUint64(&apiCallsSpent) > maxAPICalls
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"time"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// tagRestored records on a restored file that this tool restored it, as
+// private properties only visible to the app. They're the v2 equivalent
+// of the appProperties of v3.
+func (r *restorer) tagRestored(f *drive.File) {
+	properties := []*drive.Property{
+		{Key: "restoredBy", Value: "drive-untrash", Visibility: "PRIVATE"},
+		{Key: "restoredAt", Value: time.Now().UTC().Format(time.RFC3339), Visibility: "PRIVATE"},
+		{Key: "restoredRun", Value: runID, Visibility: "PRIVATE"},
+	}
+	err := p.Call(func() (bool, error) {
+		if !spendCall() {
+			return false, errBudgetExhausted
+		}
+		defer apiCalls.time("tag")()
+		_, err := r.srv.Files.Patch(f.Id, &drive.File{Properties: properties}).SupportsAllDrives(true).Fields("id").Context(r.ctx).Do()
+		return shouldRetry(err)
+	})
+	if err != nil {
+		logError("Unable to tag restored %v %v: %s%s", f.Id, f.Title, err, requestInfo(err))
+	}
+}
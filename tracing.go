@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// tracer sends the spans to an OTLP/HTTP collector, under a single root
+// span for the whole run.
+type tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+	// ctx carries the root span
+	ctx   context.Context
+	root  trace.Span
+	close sync.Once
+}
+
+// traces is nil unless -otel-endpoint is given. It's set before the run
+// starts and never changes after, spans finishing after closeTracing are
+// dropped by the provider.
+var traces *tracer
+
+// span is a timed operation of the run. All its methods are no-ops on a
+// nil span, which is what startSpan returns without -otel-endpoint.
+type span struct {
+	s        trace.Span
+	attempts int32
+}
+
+// openTracing starts the root span of the run, sending the spans to the
+// collector at endpoint, like http://localhost:4318.
+func openTracing(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%q isn't an http or https URL", endpoint)
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	if !strings.HasSuffix(path, "/v1/traces") {
+		path += "/v1/traces"
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host), otlptracehttp.WithURLPath(path), otlptracehttp.WithTimeout(30 * time.Second)}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	ctx := context.Background()
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logError("Unable to send trace spans: %v", err)
+	}))
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "drive-untrash"),
+			attribute.String("service.version", version),
+		)),
+	)
+	t := &tracer{provider: provider, tracer: provider.Tracer("drive-untrash")}
+	t.ctx, t.root = t.tracer.Start(ctx, "run", trace.WithAttributes(attribute.String("run.id", runID)))
+	traces = t
+	return nil
+}
+
+// closeTracing ends the root span and sends what's left, it's a no-op
+// without -otel-endpoint.
+func closeTracing() {
+	if traces == nil {
+		return
+	}
+	traces.close.Do(func() {
+		traces.root.End()
+		if err := traces.provider.Shutdown(context.Background()); err != nil {
+			logError("Unable to send trace spans: %v", err)
+		}
+	})
+}
+
+// startSpan starts a span under the root span of the run.
+func startSpan(name string) *span {
+	if traces == nil {
+		return nil
+	}
+	_, s := traces.tracer.Start(traces.ctx, name)
+	return &span{s: s}
+}
+
+// set adds an attribute, a string or an int.
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	switch v := value.(type) {
+	case int:
+		s.s.SetAttributes(attribute.Int(key, v))
+	default:
+		s.s.SetAttributes(attribute.String(key, fmt.Sprint(v)))
+	}
+}
+
+// attempt counts an attempt at the API call the span is about, from
+// inside the pacer.
+func (s *span) attempt() {
+	if s != nil {
+		atomic.AddInt32(&s.attempts, 1)
+	}
+}
+
+// finish ends the span, failed if err isn't nil. The provider sends it
+// in a batch, and drops it rather than holding up the run if the
+// collector is slow.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	if n := atomic.LoadInt32(&s.attempts); n > 1 {
+		s.s.SetAttributes(attribute.Int("retry.count", int(n-1)))
+	}
+	if err != nil {
+		s.s.SetStatus(codes.Error, err.Error())
+	} else {
+		s.s.SetStatus(codes.Ok, "")
+	}
+	s.s.End()
+}
+
+type spanKey struct{}
+
+// withSpan returns a copy of ctx carrying s, for the API calls made with
+// it to count their attempts on.
+func withSpan(ctx context.Context, s *span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// spanFrom returns the span carried by ctx, or nil.
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
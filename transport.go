@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// userAgentTransport adds userAgent in front of the User-Agent header set
+// by the API client.
+type userAgentTransport struct {
+	userAgent string
+	base      http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrip must not modify the request it was given
+	req = req.Clone(req.Context())
+	ua := t.userAgent
+	if existing := req.Header.Get("User-Agent"); existing != "" {
+		ua += " " + existing
+	}
+	req.Header.Set("User-Agent", ua)
+	return t.base.RoundTrip(req)
+}
+
+var errReadOnly = errors.New("refusing to modify anything in -read-only mode")
+
+// readOnlyTransport fails all requests that could modify something, so
+// that -read-only holds even if some code path forgets about it.
+type readOnlyTransport struct {
+	base http.RoundTripper
+}
+
+func (t *readOnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, errReadOnly
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+
+	drive "google.golang.org/api/drive/v2"
+)
+
+// countRevisions returns the number of revisions of f.
+func (r *restorer) countRevisions(f *drive.File) (int, error) {
+	var (
+		count     int
+		pageToken string
+	)
+	for {
+		var rl *drive.RevisionList
+		err := p.Call(func() (bool, error) {
+			if !spendCall() {
+				return false, errBudgetExhausted
+			}
+			defer apiCalls.time("revisions")()
+			call := r.srv.Revisions.List(f.Id).MaxResults(1000).Fields("nextPageToken, items(id)")
+			if pageToken != "" {
+				call.PageToken(pageToken)
+			}
+			var err error
+			rl, err = call.Context(r.ctx).Do()
+			return shouldRetry(err)
+		})
+		if err != nil {
+			return 0, err
+		}
+		count += len(rl.Items)
+		pageToken = rl.NextPageToken
+		if pageToken == "" {
+			return count, nil
+		}
+	}
+}
+
+// checkRevisions warns if f has fewer revisions than before it was
+// restored. before is negative if the revisions couldn't be counted then.
+func (r *restorer) checkRevisions(f *drive.File, folderID string, before int) {
+	if before < 0 {
+		return
+	}
+	after, err := r.countRevisions(f)
+	if err != nil {
+		logError("Unable to count revisions of %v %v after restoring it: %s%s", f.Id, f.Title, err, requestInfo(err))
+		return
+	}
+	if after < before {
+		log.Printf("Restoring %v %v in folder %v lost revisions, it had %d and now has %d", f.Id, f.Title, folderID, before, after)
+		atomic.AddUint64(&r.countRevisionsLost, 1)
+	}
+}
+
+// checkChecksum fetches f again after it was restored and warns if its
+// content checksum isn't the one it was listed with. Google Docs and
+// folders have no checksum to compare.
+func (r *restorer) checkChecksum(f *drive.File, folderID string) {
+	if f.Md5Checksum == "" {
+		return
+	}
+	var restored *drive.File
+	err := p.Call(func() (bool, error) {
+		if !spendCall() {
+			return false, errBudgetExhausted
+		}
+		defer apiCalls.time("get")()
+		var err error
+		restored, err = r.srv.Files.Get(f.Id).SupportsAllDrives(true).Fields("md5Checksum").Context(r.ctx).Do()
+		return shouldRetry(err)
+	})
+	if err != nil {
+		logError("Unable to fetch the checksum of %v %v after restoring it: %s%s", f.Id, f.Title, err, requestInfo(err))
+		return
+	}
+	if restored.Md5Checksum != f.Md5Checksum {
+		logError("Verification failed for %v %v in folder %v, its checksum was %v and now is %v", f.Id, f.Title, folderID, f.Md5Checksum, restored.Md5Checksum)
+		atomic.AddUint64(&r.countChecksumMismatch, 1)
+	}
+}
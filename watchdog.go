@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// watchdog cancels the work on a folder once it ran for longer than
+// -max-runtime-per-folder. The time the folder is held up waiting, for a
+// free worker or for a pause to end, doesn't count, so that folders aren't
+// abandoned for a busy pool. A nil watchdog never fires.
+type watchdog struct {
+	mu sync.Mutex
+	// the time left, as of started
+	left    time.Duration
+	started time.Time
+	// how many of the folder's goroutines are waiting, the clock only
+	// runs while there's none
+	waiting int
+	timer   *time.Timer
+	fire    func()
+	// set once it fired or was stopped
+	done bool
+}
+
+// newWatchdog returns a running watchdog calling fire once d has elapsed.
+func newWatchdog(d time.Duration, fire func()) *watchdog {
+	w := &watchdog{left: d, fire: fire}
+	w.mu.Lock()
+	w.run()
+	w.mu.Unlock()
+	return w
+}
+
+// run starts the clock, with w.mu held.
+func (w *watchdog) run() {
+	w.started = time.Now()
+	w.timer = time.AfterFunc(w.left, w.fire)
+}
+
+// hold stops the clock until the matching release.
+func (w *watchdog) hold() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.waiting++
+	if w.waiting == 1 && !w.done {
+		if w.timer.Stop() {
+			w.left -= time.Since(w.started)
+		} else {
+			w.done = true
+		}
+	}
+}
+
+// release restarts the clock once nothing is held up anymore.
+func (w *watchdog) release() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.waiting--
+	if w.waiting == 0 && !w.done {
+		w.run()
+	}
+}
+
+// stop stops the watchdog for good.
+func (w *watchdog) stop() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.timer.Stop()
+	w.done = true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var webhookURL string
+
+// milestoneWebhooks are the milestone webhook calls in flight, which the
+// run waits for before exiting.
+var milestoneWebhooks sync.WaitGroup
+
+// webhookClient is used for webhook calls, which don't go to Google.
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+// postWebhook POSTs payload as JSON to url, retrying on 5xx responses and
+// network errors with exponential backoff.
+func postWebhook(url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("unable to marshal webhook payload: %w", err)
+	}
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err = postWebhookOnce(url, body)
+		if err == nil || attempt == 5 {
+			return err
+		}
+		if serr, ok := err.(webhookStatusError); ok && !serr.retryable() {
+			return err
+		}
+		logWarning("Webhook call failed, retrying in %v: %v", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func postWebhookOnce(url string, body []byte) error {
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return webhookStatusError(resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookStatusError is a non-2xx response from the webhook.
+type webhookStatusError int
+
+func (e webhookStatusError) Error() string {
+	return fmt.Sprintf("webhook returned HTTP %d %s", int(e), http.StatusText(int(e)))
+}
+
+func (e webhookStatusError) retryable() bool {
+	return e >= 500 && e < 600
+}
+
+// notifyWebhook sends the summary of the run to the webhook, if configured.
+func notifyWebhook(s *summary) {
+	if webhookURL == "" {
+		return
+	}
+	if err := postWebhook(webhookURL, s); err != nil {
+		logError("Unable to notify webhook: %v", err)
+	}
+}